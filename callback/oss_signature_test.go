@@ -0,0 +1,194 @@
+package callback
+
+import (
+	"crypto"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// pubKeyServer serves PEM public keys over TLS and counts the fetches.
+type pubKeyServer struct {
+	*httptest.Server
+	mutex   sync.Mutex
+	fetches map[string]int
+}
+
+func newPubKeyServer(t *testing.T, key *rsa.PrivateKey) *pubKeyServer {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	s := &pubKeyServer{fetches: make(map[string]int)}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		s.fetches[r.URL.Path]++
+		s.mutex.Unlock()
+		w.Write(pemKey)
+	}))
+	return s
+}
+
+func (s *pubKeyServer) fetchCount(path string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.fetches[path]
+}
+
+// newTestOssVerifier trusts server and allows pub keys from it only.
+func newTestOssVerifier(server *pubKeyServer, cacheSize int) *OssSignatureVerifier {
+	host := strings.TrimPrefix(server.URL, "https://")
+	v := NewOssSignatureVerifier(OssSignatureConfig{
+		VerifySignature: true,
+		PubKeyHosts:     []string{host},
+		PubKeyCacheSize: cacheSize,
+	})
+	v.client.Transport = server.Client().Transport
+	return v
+}
+
+// signedOssCallback returns a callback request to target signed by key, as
+// OSS does.
+func signedOssCallback(t *testing.T, key *rsa.PrivateKey, target string, body string, pubKeyURL string) *http.Request {
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := u.Path
+	if u.RawQuery != "" {
+		data += "?" + u.RawQuery
+	}
+	digest := md5.Sum([]byte(data + "\n" + body))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.MD5, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", target, strings.NewReader(body))
+	r.Header.Set("Authorization", base64.StdEncoding.EncodeToString(signature))
+	r.Header.Set("x-oss-pub-key-url", base64.StdEncoding.EncodeToString([]byte(pubKeyURL)))
+	return r
+}
+
+func TestOssSignatureVerify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newPubKeyServer(t, key)
+	defer server.Close()
+	pubKeyURL := server.URL + "/pub.pem"
+	const target = "http://stash.example.com/v1/callback/oss-put-object?tag=a"
+	const body = `{"bucket":"b","object":"k"}`
+
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		body    string
+		wantErr bool
+	}{
+		{
+			name:    "good signature",
+			request: func() *http.Request { return signedOssCallback(t, key, target, body, pubKeyURL) },
+			body:    body,
+		},
+		{
+			name: "pub key advertised over http",
+			request: func() *http.Request {
+				return signedOssCallback(t, key, target, body, strings.Replace(pubKeyURL, "https://", "http://", 1))
+			},
+			body: body,
+		},
+		{
+			name:    "tampered body",
+			request: func() *http.Request { return signedOssCallback(t, key, target, body, pubKeyURL) },
+			body:    `{"bucket":"b","object":"other"}`,
+			wantErr: true,
+		},
+		{
+			name: "changed query",
+			request: func() *http.Request {
+				r := signedOssCallback(t, key, target, body, pubKeyURL)
+				r.URL.RawQuery = "tag=b"
+				return r
+			},
+			body:    body,
+			wantErr: true,
+		},
+		{
+			name: "disallowed pub key host",
+			request: func() *http.Request {
+				return signedOssCallback(t, key, target, body, "https://attacker.example.com/pub.pem")
+			},
+			body:    body,
+			wantErr: true,
+		},
+		{
+			name: "missing signature",
+			request: func() *http.Request {
+				r := signedOssCallback(t, key, target, body, pubKeyURL)
+				r.Header.Del("Authorization")
+				return r
+			},
+			body:    body,
+			wantErr: true,
+		},
+	}
+	v := newTestOssVerifier(server, 0)
+	for _, test := range tests {
+		err := v.Verify(test.request(), []byte(test.body))
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: Verify() = %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+	if n := server.fetchCount("/pub.pem"); n != 1 {
+		t.Errorf("pub key fetched %d times, want 1", n)
+	}
+
+	disabled := NewOssSignatureVerifier(OssSignatureConfig{})
+	if err := disabled.Verify(httptest.NewRequest("POST", target, nil), nil); err != nil {
+		t.Errorf("disabled verifier: Verify() = %v", err)
+	}
+}
+
+func TestOssPubKeyCacheEviction(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newPubKeyServer(t, key)
+	defer server.Close()
+	v := newTestOssVerifier(server, 2)
+
+	for _, path := range []string{"/a.pem", "/b.pem", "/c.pem", "/c.pem"} {
+		if _, err := v.pubKey(server.URL + path); err != nil {
+			t.Fatalf("pubKey(%s): %v", path, err)
+		}
+	}
+	if len(v.keys) != 2 {
+		t.Errorf("%d cached keys, want 2", len(v.keys))
+	}
+	if _, ok := v.keys[server.URL+"/a.pem"]; ok {
+		t.Errorf("oldest key was not evicted")
+	}
+	if n := server.fetchCount("/c.pem"); n != 1 {
+		t.Errorf("cached key fetched %d times, want 1", n)
+	}
+
+	// The evicted key is fetched again.
+	if _, err := v.pubKey(server.URL + "/a.pem"); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.fetchCount("/a.pem"); n != 2 {
+		t.Errorf("evicted key fetched %d times, want 2", n)
+	}
+}
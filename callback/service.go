@@ -12,6 +12,8 @@ import (
 // Service is the interface to handle callbacks from cloud service (OSS, Qiniu, etc).
 type Service interface {
 	OssPutObjectCallback(ctx context.Context, param OssCallbackParam) (CallbackResult, *base.AppError)
+	QiniuPutObjectCallback(ctx context.Context, req QiniuCallbackRequest) (CallbackResult, *base.AppError)
+	QiniuPfopNotify(ctx context.Context, notification QiniuPfopNotification) *base.AppError
 }
 
 // OssCallbackParam represents put-object callback parameters from aliyun OSS.
@@ -30,6 +32,50 @@ type OssCallbackParam struct {
 	AppUserToken string `json:"appUserToken"`
 }
 
+// QiniuCallbackRequest carries the parts of a Qiniu upload callback that are
+// covered by its "QBox" Authorization signature.
+type QiniuCallbackRequest struct {
+	Authorization string
+	Path          string
+	RawQuery      string
+	ContentType   string
+	Body          []byte
+}
+
+// QiniuCallbackParam represents upload callback parameters from Qiniu, as
+// produced by the category's callback_body.
+type QiniuCallbackParam struct {
+	Bucket       string `json:"bucket"`
+	Key          string `json:"key"`
+	Etag         string `json:"etag"`
+	Size         uint   `json:"fsize"`
+	MimeType     string `json:"mimeType"`
+	EndUser      string `json:"endUser"`
+	PersistentID string `json:"persistentId"`
+}
+
+// QiniuPfopNotification represents a persistent processing (pfop) result
+// notification from Qiniu, sent to the persistentNotifyUrl of the upload token.
+type QiniuPfopNotification struct {
+	ID          string          `json:"id"`
+	Pipeline    string          `json:"pipeline"`
+	Code        int             `json:"code"`
+	Desc        string          `json:"desc"`
+	InputBucket string          `json:"inputBucket"`
+	InputKey    string          `json:"inputKey"`
+	Items       []QiniuPfopItem `json:"items"`
+}
+
+// QiniuPfopItem is the result of one fop in a QiniuPfopNotification.
+type QiniuPfopItem struct {
+	Cmd   string `json:"cmd"`
+	Code  int    `json:"code"`
+	Desc  string `json:"desc"`
+	Error string `json:"error"`
+	Hash  string `json:"hash"`
+	Key   string `json:"key"`
+}
+
 type CallbackResult struct {
 	ObjID       uint   `json:"objID"`
 	ObjFilename string `json:"objFilename"`
@@ -39,17 +85,34 @@ type ossPutObjectCallbackRequest struct {
 	Param OssCallbackParam
 }
 
-type ossPutObjectCallbackResponse struct {
+type putObjectCallbackResponse struct {
 	Data   CallbackResult `json:"data"`
 	Status base.Status    `json:"status"`
 	Err    *base.AppError `json:"-"`
 }
 
+type qiniuPutObjectCallbackRequest struct {
+	Request QiniuCallbackRequest
+}
+
+type qiniuPfopNotifyRequest struct {
+	Notification QiniuPfopNotification
+}
+
+type qiniuPfopNotifyResponse struct {
+	Status base.Status    `json:"status"`
+	Err    *base.AppError `json:"-"`
+}
+
+func (r qiniuPfopNotifyResponse) error() *base.AppError {
+	return r.Err
+}
+
 type errorer interface {
 	error() *base.AppError
 }
 
-func (r ossPutObjectCallbackResponse) error() *base.AppError {
+func (r putObjectCallbackResponse) error() *base.AppError {
 	return r.Err
 }
 
@@ -57,6 +120,11 @@ var (
 	ErrModelFunctionFailed    = "model function failed"
 	ErrAlreadyExists          = "already exists"
 	ErrUserVerificationFailed = "user verification failed"
+	ErrDatabaseUnavailable    = "database unavailable"
+	ErrInvalidBody            = "invalid body"
+	ErrCloudService           = "cloud service error"
+	ErrInvalidSignature       = "invalid signature"
+	ErrUnknown                = "unknown error"
 )
 
 // MakePutObjectEndpoint returns an endpoint via the passed service.
@@ -64,6 +132,24 @@ func MakeOssPutObjectCallbackEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(ossPutObjectCallbackRequest)
 		result, err := s.OssPutObjectCallback(ctx, req.Param)
-		return ossPutObjectCallbackResponse{Data: result, Status: base.SuccessStatus, Err: err}, nil
+		return putObjectCallbackResponse{Data: result, Status: base.SuccessStatus, Err: err}, nil
+	}
+}
+
+// MakeQiniuPutObjectCallbackEndpoint returns an endpoint via the passed service.
+func MakeQiniuPutObjectCallbackEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(qiniuPutObjectCallbackRequest)
+		result, err := s.QiniuPutObjectCallback(ctx, req.Request)
+		return putObjectCallbackResponse{Data: result, Status: base.SuccessStatus, Err: err}, nil
+	}
+}
+
+// MakeQiniuPfopNotifyEndpoint returns an endpoint via the passed service.
+func MakeQiniuPfopNotifyEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(qiniuPfopNotifyRequest)
+		err := s.QiniuPfopNotify(ctx, req.Notification)
+		return qiniuPfopNotifyResponse{Status: base.SuccessStatus, Err: err}, nil
 	}
 }
@@ -3,30 +3,88 @@ package callback
 // Callback service implementation
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bluecover/qiniu_token/base"
+	"github.com/bluecover/qiniu_token/credentials"
 	"github.com/bluecover/qiniu_token/model"
 	"github.com/go-kit/kit/log"
 	"github.com/jinzhu/gorm"
 	"github.com/pkg/errors"
+	"github.com/qiniu/api.v7/auth/qbox"
+	"github.com/qiniu/api.v7/storage"
 )
 
-func NewService(db *gorm.DB) Service {
+// NewService creates a callback service. A nil db puts the service in
+// token-only mode, where every callback is answered with ErrDatabaseUnavailable.
+//
+// When pfopStatus is not nil, pfop notifications are only used to learn the
+// persistent ID and the job status is fetched from Qiniu instead, since the
+// notifications themselves are not signed.
+//
+// Qiniu upload callbacks are verified with the credentials in creds whose
+// access key matches the Authorization header.
+func NewService(db *gorm.DB, logger log.Logger, verifier UserVerifier, creds credentials.Provider, pfopStatus PfopStatusFetcher) Service {
 	return &serviceImpl{
-		db: db,
+		db:          db,
+		logger:      logger,
+		verifier:    verifier,
+		credentials: creds,
+		pfopStatus:  pfopStatus,
 	}
 }
 
+// PfopStatusFetcher queries the status of a Qiniu persistent processing job.
+// It is implemented by storage.OperationManager and NewPfopStatusFetcher.
+type PfopStatusFetcher interface {
+	Prefop(persistentID string) (storage.PrefopRet, error)
+}
+
+// NewPfopStatusFetcher returns a PfopStatusFetcher signing its queries with
+// the credentials keyID in creds, looked up on every call so that rotated
+// keys are picked up.
+func NewPfopStatusFetcher(creds credentials.Provider, keyID string) PfopStatusFetcher {
+	return &pfopStatusFetcher{credentials: creds, keyID: keyID}
+}
+
+type pfopStatusFetcher struct {
+	credentials credentials.Provider
+	keyID       string
+}
+
+func (f *pfopStatusFetcher) Prefop(persistentID string) (storage.PrefopRet, error) {
+	creds, err := f.credentials.Get(f.keyID)
+	if err != nil {
+		return storage.PrefopRet{}, err
+	}
+	mac := qbox.NewMac(creds.AccessKey, creds.SecretKey)
+	return storage.NewOperationManager(mac, &storage.Config{UseHTTPS: true}).Prefop(persistentID)
+}
+
 type serviceImpl struct {
-	db     *gorm.DB
-	logger log.Logger
+	db          *gorm.DB
+	logger      log.Logger
+	verifier    UserVerifier
+	credentials credentials.Provider
+	pfopStatus  PfopStatusFetcher
 }
 
 func (impl *serviceImpl) OssPutObjectCallback(ctx context.Context, param OssCallbackParam) (CallbackResult, *base.AppError) {
-	verifyUserToken(param.AppUserID, param.AppUserToken)
+	if err := impl.verifier.VerifyUser(ctx, param.AppUserID, param.AppUserToken); err != nil {
+		impl.logger.Log("callback", "OssPutObjectCallback", "user", param.AppUserID, "error", err)
+		return CallbackResult{}, base.NewAppError(ErrUserVerificationFailed, errors.Wrap(err, "VerifyUser"))
+	}
+
+	if impl.db == nil {
+		return CallbackResult{}, base.NewAppError(ErrDatabaseUnavailable, fmt.Errorf("no database configured, running in token-only mode"))
+	}
 
 	objFilename := createFilename(param.AppBusiness, param.Etag, param.ImageFormat)
 
@@ -55,9 +113,186 @@ func (impl *serviceImpl) OssPutObjectCallback(ctx context.Context, param OssCall
 	return CallbackResult{ObjID: obj.ID, ObjFilename: obj.Key}, nil
 }
 
-func verifyUserToken(userID uint, token string) bool {
-	// TODO: Verify user token (param.token)
-	return true
+func (impl *serviceImpl) QiniuPutObjectCallback(ctx context.Context, req QiniuCallbackRequest) (CallbackResult, *base.AppError) {
+	if err := verifyQiniuCallback(impl.credentials, req); err != nil {
+		impl.logger.Log("callback", "QiniuPutObjectCallback", "error", err)
+		return CallbackResult{}, base.NewAppError(ErrInvalidSignature, errors.Wrap(err, "verifyQiniuCallback"))
+	}
+
+	param, err := decodeQiniuCallbackParam(req)
+	if err != nil {
+		return CallbackResult{}, base.NewAppError(ErrInvalidBody, errors.Wrap(err, "decodeQiniuCallbackParam"))
+	}
+
+	if impl.db == nil {
+		return CallbackResult{}, base.NewAppError(ErrDatabaseUnavailable, fmt.Errorf("no database configured, running in token-only mode"))
+	}
+
+	obj := &model.Object{
+		Cloud:       "qiniu",
+		Bucket:      param.Bucket,
+		Key:         param.Key,
+		Etag:        param.Etag,
+		MimeType:    param.MimeType,
+		Size:        param.Size,
+		Status:      0,
+		CreatedTime: time.Now(),
+	}
+	err = model.StoreObject(impl.db, obj)
+	if err != nil {
+		if base.IsMySQLDuplicateEntryError(err) {
+			return CallbackResult{}, base.NewAppError(ErrAlreadyExists, errors.Wrap(err, "StoreObject"))
+		}
+		return CallbackResult{}, base.NewAppError(ErrModelFunctionFailed, errors.Wrap(err, "StoreObject"))
+	}
+
+	if len(param.PersistentID) > 0 {
+		// The pfop notification may have arrived first, so keep its result.
+		err = model.CreateProcessingJob(impl.db, &model.ProcessingJob{
+			PersistentID: param.PersistentID,
+			Bucket:       param.Bucket,
+			Key:          param.Key,
+			Code:         model.JobCodeWaiting,
+			CreatedTime:  time.Now(),
+			UpdatedTime:  time.Now(),
+		})
+		if err != nil && !base.IsMySQLDuplicateEntryError(err) {
+			return CallbackResult{}, base.NewAppError(ErrModelFunctionFailed, errors.Wrap(err, "CreateProcessingJob"))
+		}
+	}
+
+	return CallbackResult{ObjID: obj.ID, ObjFilename: obj.Key}, nil
+}
+
+func (impl *serviceImpl) QiniuPfopNotify(ctx context.Context, notification QiniuPfopNotification) *base.AppError {
+	if len(notification.ID) == 0 {
+		return base.NewAppError(ErrInvalidBody, fmt.Errorf("empty persistent id"))
+	}
+
+	if impl.pfopStatus != nil {
+		ret, err := impl.pfopStatus.Prefop(notification.ID)
+		if err != nil {
+			return base.NewAppError(ErrCloudService, errors.Wrap(err, "Prefop"))
+		}
+		notification = QiniuPfopNotification{
+			ID:          ret.ID,
+			Pipeline:    ret.Pipeline,
+			Code:        ret.Code,
+			Desc:        ret.Desc,
+			InputBucket: ret.InputBucket,
+			InputKey:    ret.InputKey,
+			Items:       make([]QiniuPfopItem, 0, len(ret.Items)),
+		}
+		for _, item := range ret.Items {
+			notification.Items = append(notification.Items, QiniuPfopItem{
+				Cmd:   item.Cmd,
+				Code:  item.Code,
+				Desc:  item.Desc,
+				Error: item.Error,
+				Hash:  item.Hash,
+				Key:   item.Key,
+			})
+		}
+	}
+
+	if impl.db == nil {
+		return base.NewAppError(ErrDatabaseUnavailable, fmt.Errorf("no database configured, running in token-only mode"))
+	}
+
+	job := &model.ProcessingJob{
+		PersistentID: notification.ID,
+		Bucket:       notification.InputBucket,
+		Key:          notification.InputKey,
+		Pipeline:     notification.Pipeline,
+		Code:         notification.Code,
+		Desc:         notification.Desc,
+		CreatedTime:  time.Now(),
+		UpdatedTime:  time.Now(),
+	}
+	ops := make([]model.ProcessingJobOp, 0, len(notification.Items))
+	for i, item := range notification.Items {
+		ops = append(ops, model.ProcessingJobOp{
+			Index: i,
+			Cmd:   item.Cmd,
+			Code:  item.Code,
+			Desc:  item.Desc,
+			Error: item.Error,
+			Key:   item.Key,
+			Hash:  item.Hash,
+		})
+	}
+	if err := model.StoreProcessingJob(impl.db, job, ops); err != nil {
+		return base.NewAppError(ErrModelFunctionFailed, errors.Wrap(err, "StoreProcessingJob"))
+	}
+	return nil
+}
+
+// qiniuCallbackContentType is the only callback body type accepted. Qiniu
+// signs the body only when the Content-Type is exactly this, so any other
+// body could be forged under a replayed Authorization header.
+const qiniuCallbackContentType = "application/x-www-form-urlencoded"
+
+// verifyQiniuCallback checks the "QBox <accessKey>:<sign>" Authorization
+// header against the credentials owning <accessKey>, rejecting bodies the
+// signature does not cover.
+func verifyQiniuCallback(provider credentials.Provider, req QiniuCallbackRequest) error {
+	if req.ContentType != qiniuCallbackContentType {
+		return fmt.Errorf("unsigned callback body type %q", req.ContentType)
+	}
+	if !strings.HasPrefix(req.Authorization, "QBox ") {
+		return fmt.Errorf("missing or malformed QBox authorization")
+	}
+	accessKey := strings.SplitN(strings.TrimPrefix(req.Authorization, "QBox "), ":", 2)[0]
+	creds, err := provider.LookupAccessKey(accessKey)
+	if err != nil {
+		return err
+	}
+	mac := qbox.NewMac(creds.AccessKey, creds.SecretKey)
+
+	u := req.Path
+	if len(req.RawQuery) > 0 {
+		u += "?" + req.RawQuery
+	}
+	httpReq, err := http.NewRequest("POST", u, bytes.NewReader(req.Body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Authorization", req.Authorization)
+	httpReq.Header.Set("Content-Type", req.ContentType)
+
+	ok, err := mac.VerifyCallback(httpReq)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("invalid QBox authorization")
+	}
+	return nil
+}
+
+func decodeQiniuCallbackParam(req QiniuCallbackRequest) (QiniuCallbackParam, error) {
+	var param QiniuCallbackParam
+	if req.ContentType != qiniuCallbackContentType {
+		return param, fmt.Errorf("unsupported content type %q", req.ContentType)
+	}
+	values, err := url.ParseQuery(string(req.Body))
+	if err != nil {
+		return param, err
+	}
+	size, err := strconv.ParseUint(values.Get("fsize"), 10, 32)
+	if err != nil {
+		return param, errors.Wrap(err, "fsize")
+	}
+	param = QiniuCallbackParam{
+		Bucket:       values.Get("bucket"),
+		Key:          values.Get("key"),
+		Etag:         values.Get("etag"),
+		Size:         uint(size),
+		MimeType:     values.Get("mimeType"),
+		EndUser:      values.Get("endUser"),
+		PersistentID: values.Get("persistentId"),
+	}
+	return param, nil
 }
 
 func createFilename(business string, etag string, format string) string {
@@ -13,19 +13,48 @@ import (
 	"github.com/pkg/errors"
 )
 
-func decodeOssPutObjectCallbackRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
-	var req ossPutObjectCallbackRequest
+func makeDecodeOssPutObjectCallbackRequest(verifier *OssSignatureVerifier) kithttp.DecodeRequestFunc {
+	return func(_ context.Context, r *http.Request) (request interface{}, err error) {
+		var req ossPutObjectCallbackRequest
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, base.NewAppError(ErrInvalidBody, errors.Wrap(err, "decodeOssPutObjectCallbackRequest:ioutil.ReadAll"))
+		}
+		if err := verifier.Verify(r, body); err != nil {
+			return nil, base.NewAppError(ErrInvalidSignature, errors.Wrap(err, "decodeOssPutObjectCallbackRequest:Verify"))
+		}
+		if err := json.Unmarshal(body, &req.Param); err != nil {
+			return nil, base.NewAppError(ErrInvalidBody, errors.Wrap(err, "decodeOssPutObjectCallbackRequest:json.Unmarshal"))
+		}
+		return req, nil
+	}
+}
+
+func decodeQiniuPutObjectCallbackRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return nil, errors.Wrap(err, "decodeOssPutObjectCallbackRequest:ioutil.ReadAll")
+		return nil, base.NewAppError(ErrInvalidBody, errors.Wrap(err, "decodeQiniuPutObjectCallbackRequest:ioutil.ReadAll"))
 	}
-	if err := json.Unmarshal(body, &req.Param); err != nil {
-		return nil, errors.Wrap(err, "decodeOssPutObjectCallbackRequest:json.Unmarshal")
+	return qiniuPutObjectCallbackRequest{
+		Request: QiniuCallbackRequest{
+			Authorization: r.Header.Get("Authorization"),
+			Path:          r.URL.Path,
+			RawQuery:      r.URL.RawQuery,
+			ContentType:   r.Header.Get("Content-Type"),
+			Body:          body,
+		},
+	}, nil
+}
+
+func decodeQiniuPfopNotifyRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req qiniuPfopNotifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req.Notification); err != nil {
+		return nil, base.NewAppError(ErrInvalidBody, errors.Wrap(err, "decodeQiniuPfopNotifyRequest:json.Decode"))
 	}
 	return req, nil
 }
 
-func encodeOssPutObjectCallbackResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	if e, ok := response.(errorer); ok && e.error() != nil {
 		encodeError(ctx, e.error(), w)
 		return nil
@@ -37,6 +66,14 @@ func encodeOssPutObjectCallbackResponse(ctx context.Context, w http.ResponseWrit
 func encodeError(_ context.Context, err *base.AppError, w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	switch err.Code {
+	case ErrInvalidSignature:
+		w.WriteHeader(http.StatusUnauthorized)
+	case ErrUserVerificationFailed:
+		w.WriteHeader(http.StatusForbidden)
+	case ErrDatabaseUnavailable:
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case ErrCloudService:
+		w.WriteHeader(http.StatusBadGateway)
 	default:
 		w.WriteHeader(http.StatusBadRequest)
 	}
@@ -45,17 +82,42 @@ func encodeError(_ context.Context, err *base.AppError, w http.ResponseWriter) {
 	})
 }
 
-func MakeHTTPHandler(s Service, logger log.Logger) http.Handler {
+// encodeTransportError encodes errors returned by decoders and endpoints.
+func encodeTransportError(ctx context.Context, err error, w http.ResponseWriter) {
+	appErr, ok := err.(*base.AppError)
+	if !ok {
+		appErr = base.NewAppError(ErrUnknown, err)
+	}
+	encodeError(ctx, appErr, w)
+}
+
+// MakeHTTPHandler mounts the callback endpoints into an http.Handler. OSS
+// callbacks are checked by ossVerifier before they reach the service.
+func MakeHTTPHandler(s Service, ossVerifier *OssSignatureVerifier, logger log.Logger) http.Handler {
 	router := mux.NewRouter()
-	endpoint := MakeOssPutObjectCallbackEndpoint(s)
 	options := []kithttp.ServerOption{
 		kithttp.ServerErrorLogger(logger),
+		kithttp.ServerErrorEncoder(encodeTransportError),
 	}
 
-	router.Methods("POST").Path("/callback/oss-put-object").Handler(kithttp.NewServer(
-		endpoint,
-		decodeOssPutObjectCallbackRequest,
-		encodeOssPutObjectCallbackResponse,
+	router.Methods("POST").Path("/v1/callback/oss-put-object").Handler(kithttp.NewServer(
+		MakeOssPutObjectCallbackEndpoint(s),
+		makeDecodeOssPutObjectCallbackRequest(ossVerifier),
+		encodeResponse,
+		options...,
+	))
+
+	router.Methods("POST").Path("/v1/callback/qiniu-put-object").Handler(kithttp.NewServer(
+		MakeQiniuPutObjectCallbackEndpoint(s),
+		decodeQiniuPutObjectCallbackRequest,
+		encodeResponse,
+		options...,
+	))
+
+	router.Methods("POST").Path("/v1/callback/qiniu-pfop").Handler(kithttp.NewServer(
+		MakeQiniuPfopNotifyEndpoint(s),
+		decodeQiniuPfopNotifyRequest,
+		encodeResponse,
 		options...,
 	))
 
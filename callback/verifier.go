@@ -0,0 +1,364 @@
+package callback
+
+// User token verification for put-object callbacks
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// UserVerifier verifies that a token was issued to the given app user.
+type UserVerifier interface {
+	VerifyUser(ctx context.Context, userID uint, token string) error
+}
+
+// UserVerifierConfig selects and configures a UserVerifier.
+type UserVerifierConfig struct {
+	Type                  string `mapstructure:"type"`
+	HMACSecret            string `mapstructure:"hmac_secret"`
+	JWKSFile              string `mapstructure:"jwks_file"`
+	JWTIssuer             string `mapstructure:"jwt_issuer"`
+	JWTAudience           string `mapstructure:"jwt_audience"`
+	IntrospectionURL      string `mapstructure:"introspection_url"`
+	IntrospectionClientID string `mapstructure:"introspection_client_id"`
+	IntrospectionSecret   string `mapstructure:"introspection_client_secret"`
+	IntrospectionTimeout  int64  `mapstructure:"introspection_timeout"`
+}
+
+const (
+	verifierTypeNone          = ""
+	verifierTypeHMAC          = "hmac"
+	verifierTypeJWT           = "jwt"
+	verifierTypeIntrospection = "introspection"
+)
+
+// NewUserVerifier creates the UserVerifier selected by config.Type. An empty
+// type yields a verifier that rejects every token.
+func NewUserVerifier(config UserVerifierConfig) (UserVerifier, error) {
+	switch config.Type {
+	case verifierTypeNone:
+		return denyAllVerifier{}, nil
+	case verifierTypeHMAC:
+		if len(config.HMACSecret) == 0 {
+			return nil, fmt.Errorf("empty hmac_secret for hmac user verifier")
+		}
+		return &hmacVerifier{secret: []byte(config.HMACSecret), now: time.Now}, nil
+	case verifierTypeJWT:
+		v := &jwtVerifier{
+			path:     config.JWKSFile,
+			issuer:   config.JWTIssuer,
+			audience: config.JWTAudience,
+			now:      time.Now,
+		}
+		if err := v.loadKeys(); err != nil {
+			return nil, err
+		}
+		return v, nil
+	case verifierTypeIntrospection:
+		if len(config.IntrospectionURL) == 0 {
+			return nil, fmt.Errorf("empty introspection_url for introspection user verifier")
+		}
+		timeout := config.IntrospectionTimeout
+		if timeout <= 0 {
+			timeout = 3
+		}
+		return &introspectionVerifier{
+			endpoint:     config.IntrospectionURL,
+			clientID:     config.IntrospectionClientID,
+			clientSecret: config.IntrospectionSecret,
+			client:       &http.Client{Timeout: time.Second * time.Duration(timeout)},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown user verifier type: %s", config.Type)
+}
+
+// denyAllVerifier is used when no verifier is configured, so that callbacks
+// fail closed instead of trusting the caller.
+type denyAllVerifier struct{}
+
+func (denyAllVerifier) VerifyUser(ctx context.Context, userID uint, token string) error {
+	return fmt.Errorf("no user verifier configured")
+}
+
+// hmacVerifier accepts tokens of the form "<expires>:<signature>", where
+// expires is a unix timestamp and signature is the base64url-encoded
+// HMAC-SHA256 of "<userID>:<expires>" under the shared secret.
+type hmacVerifier struct {
+	secret []byte
+	now    func() time.Time
+}
+
+func (v *hmacVerifier) VerifyUser(ctx context.Context, userID uint, token string) error {
+	parts := strings.SplitN(token, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("malformed token")
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed token expiration")
+	}
+	if v.now().Unix() > expires {
+		return fmt.Errorf("token expired")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return fmt.Errorf("malformed token signature")
+	}
+
+	mac := hmac.New(sha256.New, v.secret)
+	fmt.Fprintf(mac, "%d:%d", userID, expires)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return fmt.Errorf("invalid token signature")
+	}
+	return nil
+}
+
+// jwtVerifier accepts RS256 JWTs signed by a key from a JWKS file whose "sub"
+// claim is the user ID. A token with an unknown kid makes it read the file
+// again if it has changed, so that keys can be rotated without a restart.
+type jwtVerifier struct {
+	path     string
+	issuer   string
+	audience string
+	now      func() time.Time
+
+	mutex   sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	modTime time.Time
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+}
+
+func (v *jwtVerifier) VerifyUser(ctx context.Context, userID uint, token string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed jwt")
+	}
+
+	var header jwtHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return errors.Wrap(err, "jwt header")
+	}
+	if header.Alg != "RS256" {
+		return fmt.Errorf("unsupported jwt alg: %s", header.Alg)
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errors.Wrap(err, "jwt signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return fmt.Errorf("invalid jwt signature")
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return errors.Wrap(err, "jwt claims")
+	}
+	now := v.now().Unix()
+	if claims.ExpiresAt == 0 || now > claims.ExpiresAt {
+		return fmt.Errorf("jwt expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return fmt.Errorf("jwt not yet valid")
+	}
+	if len(v.issuer) > 0 && claims.Issuer != v.issuer {
+		return fmt.Errorf("unexpected jwt issuer: %s", claims.Issuer)
+	}
+	if len(v.audience) > 0 && !audienceContains(claims.Audience, v.audience) {
+		return fmt.Errorf("unexpected jwt audience")
+	}
+	if claims.Subject != strconv.FormatUint(uint64(userID), 10) {
+		return fmt.Errorf("jwt subject does not match user %d", userID)
+	}
+	return nil
+}
+
+// key returns the key of kid, reading the JWKS file again when kid is unknown
+// and the file has changed since it was last read.
+func (v *jwtVerifier) key(kid string) (*rsa.PublicKey, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if info, err := os.Stat(v.path); err == nil && !info.ModTime().Equal(v.modTime) {
+		if err := v.loadKeys(); err != nil {
+			return nil, errors.Wrap(err, "reload jwks")
+		}
+		if key, ok := v.keys[kid]; ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown jwt kid: %s", kid)
+}
+
+// loadKeys reads the JWKS file, keeping the current keys on failure. The
+// caller holds v.mutex once v is shared.
+func (v *jwtVerifier) loadKeys() error {
+	if len(v.path) == 0 {
+		return fmt.Errorf("empty jwks_file for jwt user verifier")
+	}
+	info, err := os.Stat(v.path)
+	if err != nil {
+		return errors.Wrap(err, "read jwks file")
+	}
+	keys, err := loadJWKSFile(v.path)
+	if err != nil {
+		return err
+	}
+	v.keys = keys
+	v.modTime = info.ModTime()
+	return nil
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	content, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+// audienceContains handles "aud" being either a string or a list of strings.
+func audienceContains(raw json.RawMessage, audience string) bool {
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return single == audience
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err == nil {
+		for _, aud := range list {
+			if aud == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type jwks struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+// loadJWKSFile reads the RSA signing keys of a JWKS document, indexed by kid.
+func loadJWKSFile(path string) (map[string]*rsa.PublicKey, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read jwks file")
+	}
+	var set jwks
+	if err := json.Unmarshal(content, &set); err != nil {
+		return nil, errors.Wrap(err, "parse jwks file")
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (len(k.Use) > 0 && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, errors.Wrapf(err, "jwks key %s: modulus", k.Kid)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, errors.Wrapf(err, "jwks key %s: exponent", k.Kid)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no RSA signing keys in %s", path)
+	}
+	return keys, nil
+}
+
+// introspectionVerifier asks an OAuth2 token introspection endpoint (RFC 7662)
+// whether the token is active and belongs to the user.
+type introspectionVerifier struct {
+	endpoint     string
+	clientID     string
+	clientSecret string
+	client       *http.Client
+}
+
+type introspectionResponse struct {
+	Active  bool   `json:"active"`
+	Subject string `json:"sub"`
+}
+
+func (v *introspectionVerifier) VerifyUser(ctx context.Context, userID uint, token string) error {
+	form := url.Values{"token": {token}}
+	req, err := http.NewRequest("POST", v.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return errors.Wrap(err, "introspection request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(v.clientID) > 0 {
+		req.SetBasicAuth(v.clientID, v.clientSecret)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "introspection request")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("introspection endpoint returned %d", resp.StatusCode)
+	}
+
+	var result introspectionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return errors.Wrap(err, "introspection response")
+	}
+	if !result.Active {
+		return fmt.Errorf("token is not active")
+	}
+	if result.Subject != strconv.FormatUint(uint64(userID), 10) {
+		return fmt.Errorf("token subject does not match user %d", userID)
+	}
+	return nil
+}
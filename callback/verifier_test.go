@@ -0,0 +1,257 @@
+package callback
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var verifierTestNow = time.Unix(1800000000, 0)
+
+func TestDenyAllVerifier(t *testing.T) {
+	v, err := NewUserVerifier(UserVerifierConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.VerifyUser(context.Background(), 42, "anything"); err == nil {
+		t.Errorf("VerifyUser succeeded without a configured verifier")
+	}
+	if _, err := NewUserVerifier(UserVerifierConfig{Type: "plain"}); err == nil {
+		t.Errorf("NewUserVerifier accepted an unknown type")
+	}
+}
+
+func hmacToken(secret string, userID uint, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d:%d", userID, expires)
+	return fmt.Sprintf("%d:%s", expires, base64.RawURLEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+func TestHMACVerifier(t *testing.T) {
+	v := &hmacVerifier{secret: []byte("secret"), now: func() time.Time { return verifierTestNow }}
+	expires := verifierTestNow.Unix() + 60
+
+	tests := []struct {
+		name    string
+		userID  uint
+		token   string
+		wantErr bool
+	}{
+		{"valid", 42, hmacToken("secret", 42, expires), false},
+		{"wrong signature", 42, hmacToken("other", 42, expires), true},
+		{"other user", 43, hmacToken("secret", 42, expires), true},
+		{"expired", 42, hmacToken("secret", 42, verifierTestNow.Unix()-1), true},
+		{"changed expiration", 42, strings.Replace(hmacToken("secret", 42, expires), fmt.Sprint(expires), fmt.Sprint(expires+3600), 1), true},
+		{"malformed", 42, "token", true},
+	}
+	for _, test := range tests {
+		err := v.VerifyUser(context.Background(), test.userID, test.token)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: VerifyUser() = %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+// writeJWKS writes the public keys of keys, indexed by kid, as a JWKS file.
+func writeJWKS(t *testing.T, path string, keys map[string]*rsa.PrivateKey) {
+	var set jwks
+	for kid, key := range keys {
+		set.Keys = append(set.Keys, struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		}{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	content, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// signJWT returns a JWT of claims with the given header fields, signed with
+// RS256 by key.
+func signJWT(t *testing.T, key *rsa.PrivateKey, alg string, kid string, claims map[string]interface{}) string {
+	segment := func(v interface{}) string {
+		content, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(content)
+	}
+	signed := segment(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTVerifier(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jwks.json")
+	writeJWKS(t, path, map[string]*rsa.PrivateKey{"k1": key})
+
+	verifier, err := NewUserVerifier(UserVerifierConfig{Type: "jwt", JWKSFile: path, JWTIssuer: "auth", JWTAudience: "stash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier.(*jwtVerifier).now = func() time.Time { return verifierTestNow }
+
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub": "42",
+			"iss": "auth",
+			"aud": []string{"other", "stash"},
+			"exp": verifierTestNow.Unix() + 60,
+		}
+		for name, value := range changes {
+			c[name] = value
+		}
+		return c
+	}
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"valid", signJWT(t, key, "RS256", "k1", claims(nil)), false},
+		{"wrong signature", signJWT(t, otherKey, "RS256", "k1", claims(nil)), true},
+		{"expired", signJWT(t, key, "RS256", "k1", claims(map[string]interface{}{"exp": verifierTestNow.Unix() - 1})), true},
+		{"not yet valid", signJWT(t, key, "RS256", "k1", claims(map[string]interface{}{"nbf": verifierTestNow.Unix() + 60})), true},
+		{"wrong alg", signJWT(t, key, "HS256", "k1", claims(nil)), true},
+		{"wrong kid", signJWT(t, key, "RS256", "k2", claims(nil)), true},
+		{"other user", signJWT(t, key, "RS256", "k1", claims(map[string]interface{}{"sub": "43"})), true},
+		{"wrong issuer", signJWT(t, key, "RS256", "k1", claims(map[string]interface{}{"iss": "other"})), true},
+		{"wrong audience", signJWT(t, key, "RS256", "k1", claims(map[string]interface{}{"aud": "other"})), true},
+		{"malformed", "a.b", true},
+	}
+	for _, test := range tests {
+		err := verifier.VerifyUser(context.Background(), 42, test.token)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: VerifyUser() = %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestJWTVerifierRefetchesJWKS(t *testing.T) {
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jwks.json")
+	writeJWKS(t, path, map[string]*rsa.PrivateKey{"old": oldKey})
+
+	verifier, err := NewUserVerifier(UserVerifierConfig{Type: "jwt", JWKSFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier.(*jwtVerifier).now = func() time.Time { return verifierTestNow }
+	token := signJWT(t, newKey, "RS256", "new", map[string]interface{}{"sub": "42", "exp": verifierTestNow.Unix() + 60})
+
+	if err := verifier.VerifyUser(context.Background(), 42, token); err == nil {
+		t.Fatalf("VerifyUser accepted a kid missing from the JWKS file")
+	}
+
+	// Rotate the keys; the unknown kid makes the verifier read the file again.
+	writeJWKS(t, path, map[string]*rsa.PrivateKey{"old": oldKey, "new": newKey})
+	modTime := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.VerifyUser(context.Background(), 42, token); err != nil {
+		t.Errorf("VerifyUser after rotation: %v", err)
+	}
+}
+
+func TestIntrospectionVerifier(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, ok := r.BasicAuth(); !ok || id != "stash" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.PostFormValue("token") {
+		case "active":
+			fmt.Fprint(w, `{"active": true, "sub": "42"}`)
+		case "inactive":
+			fmt.Fprint(w, `{"active": false}`)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	verifier, err := NewUserVerifier(UserVerifierConfig{
+		Type:                  "introspection",
+		IntrospectionURL:      server.URL,
+		IntrospectionClientID: "stash",
+		IntrospectionSecret:   "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		userID  uint
+		token   string
+		wantErr bool
+	}{
+		{"valid", 42, "active", false},
+		{"other user", 43, "active", true},
+		{"inactive", 42, "inactive", true},
+		{"non-200", 42, "error", true},
+	}
+	for _, test := range tests {
+		err := verifier.VerifyUser(context.Background(), test.userID, test.token)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: VerifyUser() = %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package credentials
+
+// Credential providers for cloud signers
+//
+// Every access key pair is identified by a key ID, so that several accounts
+// of the same cloud can coexist. Pairs come from config files, environment
+// variables or a mounted secrets file; Chain combines them.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Credentials is an access key pair, valid from ActivateAt until ExpireAt
+// when those are set.
+type Credentials struct {
+	KeyID      string
+	AccessKey  string
+	SecretKey  string
+	ActivateAt time.Time
+	ExpireAt   time.Time
+}
+
+// Provider looks up credentials by key ID, or by access key when verifying
+// requests that carry the access key (e.g. Qiniu callbacks). Get returns the
+// key that signs now, LookupAccessKey accepts every valid key of a KeySet.
+type Provider interface {
+	Get(keyID string) (Credentials, error)
+	LookupAccessKey(accessKey string) (Credentials, error)
+	KeySet(keyID string) (KeySet, error)
+}
+
+// ErrNotFound is returned when no source knows the requested credentials.
+type ErrNotFound struct {
+	What string
+}
+
+func (e *ErrNotFound) Error() string {
+	return fmt.Sprintf("credentials not found: %s", e.What)
+}
+
+// IsNotFound reports whether err is an ErrNotFound.
+func IsNotFound(err error) bool {
+	_, ok := err.(*ErrNotFound)
+	return ok
+}
+
+// Chain returns a Provider that asks each provider in turn and returns the
+// first match.
+func Chain(providers ...Provider) Provider {
+	return chainProvider(providers)
+}
+
+type chainProvider []Provider
+
+func (c chainProvider) Get(keyID string) (Credentials, error) {
+	for _, p := range c {
+		creds, err := p.Get(keyID)
+		if err == nil || !IsNotFound(err) {
+			return creds, err
+		}
+	}
+	return Credentials{}, &ErrNotFound{What: "key id " + keyID}
+}
+
+func (c chainProvider) LookupAccessKey(accessKey string) (Credentials, error) {
+	for _, p := range c {
+		creds, err := p.LookupAccessKey(accessKey)
+		if err == nil || !IsNotFound(err) {
+			return creds, err
+		}
+	}
+	return Credentials{}, &ErrNotFound{What: "access key " + accessKey}
+}
+
+func (c chainProvider) KeySet(keyID string) (KeySet, error) {
+	for _, p := range c {
+		set, err := p.KeySet(keyID)
+		if err == nil || !IsNotFound(err) {
+			return set, err
+		}
+	}
+	return KeySet{}, &ErrNotFound{What: "key id " + keyID}
+}
+
+// staticProvider serves a fixed set of key sets indexed by key ID.
+type staticProvider map[string]KeySet
+
+func (s staticProvider) Get(keyID string) (Credentials, error) {
+	set, err := s.KeySet(keyID)
+	if err != nil {
+		return Credentials{}, err
+	}
+	return set.Signing(time.Now())
+}
+
+func (s staticProvider) LookupAccessKey(accessKey string) (Credentials, error) {
+	now := time.Now()
+	for _, set := range s {
+		if creds, ok := set.lookup(accessKey, now); ok {
+			return creds, nil
+		}
+	}
+	return Credentials{}, &ErrNotFound{What: "access key " + accessKey}
+}
+
+func (s staticProvider) KeySet(keyID string) (KeySet, error) {
+	set, ok := s[keyID]
+	if !ok {
+		return KeySet{}, &ErrNotFound{What: "key id " + keyID}
+	}
+	return set, nil
+}
+
+// add reads the key set stored under prefix ("" or "<table>.") of v, naming
+// the key pair settings accessKeyName and secretKeyName.
+func (s staticProvider) add(v *viper.Viper, keyID string, prefix string, accessKeyName string, secretKeyName string) {
+	read := func(prefix string) (Credentials, bool) {
+		creds := Credentials{
+			KeyID:      keyID,
+			AccessKey:  v.GetString(prefix + accessKeyName),
+			SecretKey:  v.GetString(prefix + secretKeyName),
+			ActivateAt: v.GetTime(prefix + "activate_at"),
+			ExpireAt:   v.GetTime(prefix + "expire_at"),
+		}
+		return creds, len(creds.AccessKey) > 0 && len(creds.SecretKey) > 0
+	}
+	primary, ok := read(prefix)
+	if !ok {
+		return
+	}
+	set := KeySet{Primary: primary}
+	if secondary, ok := read(prefix + "secondary."); ok {
+		set.Secondary = &secondary
+	}
+	s[keyID] = set
+}
+
+// NewEnvProvider reads credentials from <prefix>_<KEY_ID>_ACCESS_KEY and
+// <prefix>_<KEY_ID>_SECRET_KEY, where the key ID is upper-cased and "-" and
+// "." become "_". Optional _ACTIVATE_AT and _EXPIRE_AT variables hold RFC
+// 3339 timestamps, and the same variables with _SECONDARY_ after the key ID
+// describe the secondary key.
+func NewEnvProvider(prefix string) Provider {
+	return &envProvider{prefix: strings.ToUpper(prefix)}
+}
+
+type envProvider struct {
+	prefix string
+}
+
+func (e *envProvider) envName(keyID string, suffix string) string {
+	id := strings.NewReplacer("-", "_", ".", "_").Replace(strings.ToUpper(keyID))
+	return fmt.Sprintf("%s_%s_%s", e.prefix, id, suffix)
+}
+
+func (e *envProvider) Get(keyID string) (Credentials, error) {
+	set, err := e.KeySet(keyID)
+	if err != nil {
+		return Credentials{}, err
+	}
+	return set.Signing(time.Now())
+}
+
+func (e *envProvider) KeySet(keyID string) (KeySet, error) {
+	read := func(slot string) (Credentials, bool, error) {
+		creds := Credentials{
+			KeyID:     keyID,
+			AccessKey: os.Getenv(e.envName(keyID, slot+"ACCESS_KEY")),
+			SecretKey: os.Getenv(e.envName(keyID, slot+"SECRET_KEY")),
+		}
+		if len(creds.AccessKey) == 0 || len(creds.SecretKey) == 0 {
+			return creds, false, nil
+		}
+		for name, t := range map[string]*time.Time{"ACTIVATE_AT": &creds.ActivateAt, "EXPIRE_AT": &creds.ExpireAt} {
+			value := os.Getenv(e.envName(keyID, slot+name))
+			if len(value) == 0 {
+				continue
+			}
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return creds, false, fmt.Errorf("%s: %s", e.envName(keyID, slot+name), err)
+			}
+			*t = parsed
+		}
+		return creds, true, nil
+	}
+
+	primary, ok, err := read("")
+	if err != nil {
+		return KeySet{}, err
+	}
+	if !ok {
+		return KeySet{}, &ErrNotFound{What: "key id " + keyID}
+	}
+	set := KeySet{Primary: primary}
+	secondary, ok, err := read("SECONDARY_")
+	if err != nil {
+		return KeySet{}, err
+	}
+	if ok {
+		set.Secondary = &secondary
+	}
+	return set, nil
+}
+
+func (e *envProvider) LookupAccessKey(accessKey string) (Credentials, error) {
+	prefix := e.prefix + "_"
+	now := time.Now()
+	for _, env := range os.Environ() {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 || parts[1] != accessKey || !strings.HasPrefix(parts[0], prefix) || !strings.HasSuffix(parts[0], "_ACCESS_KEY") {
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(parts[0], prefix), "_ACCESS_KEY")
+		id = strings.ToLower(strings.TrimSuffix(id, "_SECONDARY"))
+		set, err := e.KeySet(id)
+		if err != nil {
+			continue
+		}
+		if creds, ok := set.lookup(accessKey, now); ok {
+			return creds, nil
+		}
+	}
+	return Credentials{}, &ErrNotFound{What: "access key " + accessKey}
+}
+
+// NewSecretsFileProvider reads credentials from a mounted secrets file (TOML,
+// JSON or YAML, by extension) with one table per key ID:
+//
+//	[qiniu]
+//	access_key = "..."
+//	secret_key = "..."
+//	activate_at = 2026-11-01T00:00:00Z  # optional
+//
+//	[qiniu.secondary]  # optional, see KeySet
+//	access_key = "..."
+//	secret_key = "..."
+//	expire_at = 2026-11-02T00:00:00Z
+//
+// The file is re-read whenever it changes on disk.
+func NewSecretsFileProvider(path string) Provider {
+	return &fileProvider{
+		path: path,
+		parse: func(v *viper.Viper, creds staticProvider) {
+			for keyID := range v.AllSettings() {
+				creds.add(v, keyID, keyID+".", "access_key", "secret_key")
+			}
+		},
+	}
+}
+
+// NewConfigProvider reads credentials from the service config files under
+// configPath:
+//   - qiniu.toml: access_key/secret_key, under key_id (default "qiniu"), and
+//     those of every [account.<name>], under its key_id (default
+//     "qiniu-<name>")
+//   - stash.toml: aliyun.access_key_id/access_key_secret, under aliyun.key_id
+//     (default "aliyun"), those of every [aliyun.account.<name>], under its
+//     key_id (default "aliyun-<name>"), s3.access_key/secret_key, under
+//     s3.key_id (default "s3"), and any [credentials.keys.<key id>] table
+//
+// Each of them may hold a [secondary] sub-table and activate_at/expire_at
+// settings, see KeySet. As everywhere else in stash.toml, environment
+// variables override its settings, e.g. STASH_ALIYUN_ACCESS_KEY_ID for
+// aliyun.access_key_id. The files are re-read whenever they change on disk.
+func NewConfigProvider(configPath string) Provider {
+	return Chain(
+		&fileProvider{
+			path: filepath.Join(configPath, "qiniu.toml"),
+			parse: func(v *viper.Viper, creds staticProvider) {
+				v.SetDefault("key_id", DefaultQiniuKeyID)
+				creds.add(v, v.GetString("key_id"), "", "access_key", "secret_key")
+				addAccounts(v, "account", DefaultQiniuKeyID, "access_key", "secret_key", creds)
+			},
+		},
+		&fileProvider{
+			path:      filepath.Join(configPath, "stash.toml"),
+			envPrefix: StashEnvPrefix,
+			parse: func(v *viper.Viper, creds staticProvider) {
+				v.SetDefault("aliyun.key_id", DefaultAliyunKeyID)
+				creds.add(v, v.GetString("aliyun.key_id"), "aliyun.", "access_key_id", "access_key_secret")
+				addAccounts(v, "aliyun.account", DefaultAliyunKeyID, "access_key_id", "access_key_secret", creds)
+				v.SetDefault("s3.key_id", DefaultS3KeyID)
+				creds.add(v, v.GetString("s3.key_id"), "s3.", "access_key", "secret_key")
+				for keyID := range v.GetStringMap("credentials.keys") {
+					creds.add(v, keyID, "credentials.keys."+keyID+".", "access_key", "secret_key")
+				}
+			},
+		},
+	)
+}
+
+// addAccounts adds the keys of the named account tables under section, whose
+// key IDs default to "<cloud>-<name>".
+func addAccounts(v *viper.Viper, section string, cloud string, accessKeyName string, secretKeyName string, creds staticProvider) {
+	for name := range v.GetStringMap(section) {
+		prefix := section + "." + name + "."
+		keyID := v.GetString(prefix + "key_id")
+		if len(keyID) == 0 {
+			keyID = cloud + "-" + name
+		}
+		creds.add(v, keyID, prefix, accessKeyName, secretKeyName)
+	}
+}
+
+// StashEnvPrefix prefixes the environment variables that override stash.toml
+// settings.
+const StashEnvPrefix = "stash"
+
+// Default key IDs of the single-account config keys.
+const (
+	DefaultQiniuKeyID  = "qiniu"
+	DefaultAliyunKeyID = "aliyun"
+	DefaultS3KeyID     = "s3"
+)
+
+// fileProvider parses a config file into credentials and caches them until
+// the file's modification time changes. With envPrefix set, environment
+// variables named <envPrefix>_<SETTING> override the settings of the file.
+type fileProvider struct {
+	path      string
+	envPrefix string
+	parse     func(v *viper.Viper, creds staticProvider)
+
+	mutex   sync.Mutex
+	modTime time.Time
+	creds   staticProvider
+}
+
+func (f *fileProvider) load() (staticProvider, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return staticProvider{}, nil
+		}
+		return nil, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.creds != nil && info.ModTime().Equal(f.modTime) {
+		return f.creds, nil
+	}
+
+	v := viper.New()
+	v.SetConfigFile(f.path)
+	if err := v.ReadInConfig(); err != nil {
+		if f.creds != nil {
+			// Keep serving the last good credentials while the file is being rewritten.
+			return f.creds, nil
+		}
+		return nil, fmt.Errorf("read credentials from %s: %s", f.path, err)
+	}
+	if len(f.envPrefix) > 0 {
+		v.AutomaticEnv()
+		v.SetEnvPrefix(f.envPrefix)
+		v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	}
+	creds := staticProvider{}
+	f.parse(v, creds)
+	f.creds = creds
+	f.modTime = info.ModTime()
+	return creds, nil
+}
+
+func (f *fileProvider) Get(keyID string) (Credentials, error) {
+	creds, err := f.load()
+	if err != nil {
+		return Credentials{}, err
+	}
+	return creds.Get(keyID)
+}
+
+func (f *fileProvider) KeySet(keyID string) (KeySet, error) {
+	creds, err := f.load()
+	if err != nil {
+		return KeySet{}, err
+	}
+	return creds.KeySet(keyID)
+}
+
+func (f *fileProvider) LookupAccessKey(accessKey string) (Credentials, error) {
+	creds, err := f.load()
+	if err != nil {
+		return Credentials{}, err
+	}
+	return creds.LookupAccessKey(accessKey)
+}
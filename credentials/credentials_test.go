@@ -0,0 +1,54 @@
+package credentials
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigProviderStashEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stash := `
+[aliyun]
+access_key_id = ""
+access_key_secret = ""
+
+[s3]
+access_key = "file-access"
+secret_key = "file-secret"
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "stash.toml"), []byte(stash), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("STASH_ALIYUN_ACCESS_KEY_ID", "env-aliyun-access")
+	t.Setenv("STASH_ALIYUN_ACCESS_KEY_SECRET", "env-aliyun-secret")
+	t.Setenv("STASH_S3_SECRET_KEY", "env-s3-secret")
+
+	provider := NewConfigProvider(dir)
+	tests := []struct {
+		keyID      string
+		wantAccess string
+		wantSecret string
+	}{
+		{DefaultAliyunKeyID, "env-aliyun-access", "env-aliyun-secret"},
+		{DefaultS3KeyID, "file-access", "env-s3-secret"},
+	}
+	for _, test := range tests {
+		creds, err := provider.Get(test.keyID)
+		if err != nil {
+			t.Errorf("Get(%q): %v", test.keyID, err)
+			continue
+		}
+		if creds.AccessKey != test.wantAccess || creds.SecretKey != test.wantSecret {
+			t.Errorf("Get(%q) = %q/%q, want %q/%q", test.keyID, creds.AccessKey, creds.SecretKey, test.wantAccess, test.wantSecret)
+		}
+	}
+	if creds, err := provider.LookupAccessKey("env-aliyun-access"); err != nil || creds.KeyID != DefaultAliyunKeyID {
+		t.Errorf("LookupAccessKey() = %+v, %v", creds, err)
+	}
+}
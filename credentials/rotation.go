@@ -0,0 +1,63 @@
+package credentials
+
+// Key rotation
+//
+// A key ID holds a primary and optionally a secondary key pair. To rotate a
+// key without downtime, add the new pair as primary with activate_at set to
+// the switch-over time, and move the old pair to secondary with expire_at
+// set to the end of the overlap window, at least the longest token or
+// private URL lifetime later. The secondary pair signs until the primary
+// activates; callbacks signed with either are accepted while it is valid.
+// Qiniu checks private URLs itself, so keep the old key enabled there until
+// expire_at as well.
+
+import (
+	"fmt"
+	"time"
+)
+
+// Key slots of a KeySet.
+const (
+	SlotPrimary   = "primary"
+	SlotSecondary = "secondary"
+)
+
+// KeySet is the primary and secondary key pair of a key ID.
+type KeySet struct {
+	Primary   Credentials
+	Secondary *Credentials
+}
+
+// ValidAt reports whether the pair may be used at now.
+func (c Credentials) ValidAt(now time.Time) bool {
+	return !now.Before(c.ActivateAt) && (c.ExpireAt.IsZero() || now.Before(c.ExpireAt))
+}
+
+// Signing returns the pair signing at now: the primary once it is valid,
+// else the secondary.
+func (s KeySet) Signing(now time.Time) (Credentials, error) {
+	creds, _, err := s.Active(now)
+	return creds, err
+}
+
+// Active is Signing that also reports the slot of the pair.
+func (s KeySet) Active(now time.Time) (Credentials, string, error) {
+	if s.Primary.ValidAt(now) {
+		return s.Primary, SlotPrimary, nil
+	}
+	if s.Secondary != nil && s.Secondary.ValidAt(now) {
+		return *s.Secondary, SlotSecondary, nil
+	}
+	return Credentials{}, "", fmt.Errorf("no valid key for key id %s", s.Primary.KeyID)
+}
+
+// lookup returns the valid pair of the set whose access key is accessKey.
+func (s KeySet) lookup(accessKey string, now time.Time) (Credentials, bool) {
+	if s.Primary.AccessKey == accessKey && s.Primary.ValidAt(now) {
+		return s.Primary, true
+	}
+	if s.Secondary != nil && s.Secondary.AccessKey == accessKey && s.Secondary.ValidAt(now) {
+		return *s.Secondary, true
+	}
+	return Credentials{}, false
+}
@@ -0,0 +1,116 @@
+package health
+
+// Liveness and readiness probes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluecover/qiniu_token/base"
+	"github.com/go-kit/kit/log"
+)
+
+// CheckFunc reports whether a dependency is ready to serve traffic.
+type CheckFunc func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check CheckFunc
+}
+
+// Health collects readiness checks and tracks whether the server is draining.
+type Health struct {
+	checks   []namedCheck
+	timeout  time.Duration
+	draining int32
+	logger   log.Logger
+}
+
+// New creates a Health whose readiness checks are bounded by timeout.
+func New(timeout time.Duration, logger log.Logger) *Health {
+	return &Health{
+		timeout: timeout,
+		logger:  logger,
+	}
+}
+
+// AddCheck registers a named readiness check.
+func (h *Health) AddCheck(name string, check CheckFunc) {
+	h.checks = append(h.checks, namedCheck{name: name, check: check})
+}
+
+// Drain marks the server as shutting down, so that readiness fails and load
+// balancers stop routing new requests while in-flight ones complete.
+func (h *Health) Drain() {
+	atomic.StoreInt32(&h.draining, 1)
+}
+
+func (h *Health) isDraining() bool {
+	return atomic.LoadInt32(&h.draining) == 1
+}
+
+// MakeHTTPHandler mounts /healthz and /readyz into an http.Handler.
+func (h *Health) MakeHTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.serveLiveness)
+	mux.HandleFunc("/readyz", h.serveReadiness)
+	return mux
+}
+
+func (h *Health) serveLiveness(w http.ResponseWriter, r *http.Request) {
+	encodeResponse(w, http.StatusOK, base.SuccessStatus, nil)
+}
+
+func (h *Health) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	if h.isDraining() {
+		encodeResponse(w, http.StatusServiceUnavailable, *base.NewStatus("draining", "server is shutting down"), nil)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+
+	results := make(map[string]string, len(h.checks))
+	ready := true
+	for _, c := range h.checks {
+		if err := c.check(ctx); err != nil {
+			ready = false
+			results[c.name] = err.Error()
+			h.logger.Log("readiness", c.name, "error", err)
+		} else {
+			results[c.name] = "ok"
+		}
+	}
+
+	if !ready {
+		encodeResponse(w, http.StatusServiceUnavailable, *base.NewStatus("not ready", fmt.Sprintf("%d check(s) failed", countFailed(results))), results)
+		return
+	}
+	encodeResponse(w, http.StatusOK, base.SuccessStatus, results)
+}
+
+func countFailed(results map[string]string) int {
+	n := 0
+	for _, r := range results {
+		if r != "ok" {
+			n++
+		}
+	}
+	return n
+}
+
+func encodeResponse(w http.ResponseWriter, code int, status base.Status, checks map[string]string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	body := map[string]interface{}{
+		"status": status,
+	}
+	if checks != nil {
+		body["checks"] = checks
+	}
+	json.NewEncoder(w).Encode(body)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
@@ -9,8 +10,12 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/bluecover/qiniu_token/callback"
+	"github.com/bluecover/qiniu_token/credentials"
+	"github.com/bluecover/qiniu_token/health"
 	"github.com/bluecover/qiniu_token/model"
 	"github.com/bluecover/qiniu_token/object"
+	"github.com/fsnotify/fsnotify"
 	"github.com/go-kit/kit/log"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
@@ -18,25 +23,110 @@ import (
 )
 
 func initConfig(configPath string) {
-	viper.AddConfigPath(configPath)
-	viper.SetConfigName("stash")
-	err := viper.ReadInConfig()
-	if err != nil {
+	if err := loadStashConfig(viper.GetViper(), configPath); err != nil {
 		panic(fmt.Errorf("fatal error config file: %s \n", err))
 	}
+}
+
+// loadStashConfig reads stash.toml from configPath into v, with defaults and
+// STASH_ environment overrides.
+func loadStashConfig(v *viper.Viper, configPath string) error {
+	v.AddConfigPath(configPath)
+	v.SetConfigName("stash")
+	if err := v.ReadInConfig(); err != nil {
+		return err
+	}
+
+	v.SetDefault("server.read_timeout", 10)
+	v.SetDefault("server.write_timeout", 30)
+	v.SetDefault("server.idle_timeout", 120)
+	v.SetDefault("server.shutdown_timeout", 30)
+	v.SetDefault("server.drain_delay", 5)
+	v.SetDefault("server.readiness_timeout", 2)
+	v.SetDefault("server.private_url_batch_limit", 200)
+	v.SetDefault("server.admin_addr", "localhost")
+	v.SetDefault("credentials.env_prefix", "STASH_CREDENTIALS")
+	v.SetDefault("callback.qiniu.key_id", credentials.DefaultQiniuKeyID)
+
+	v.AutomaticEnv()
+	v.SetEnvPrefix(credentials.StashEnvPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	return nil
+}
+
+// watchConfig reloads stash.toml when it changes. The file is loaded into a
+// fresh viper and swapped in only if it parses and passes validation, so
+// requests never see a half-read file. Settings read per request take effect
+// immediately; the others (database, callback verification, server) still
+// require a restart.
+func watchConfig(configPath string, logger log.Logger) {
+	// The watcher's own copy is re-read by viper on every change and never
+	// read by requests.
+	watcher := viper.New()
+	watcher.AddConfigPath(configPath)
+	watcher.SetConfigName("stash")
+	if err := watcher.ReadInConfig(); err != nil {
+		logger.Log("config", "stash", "watch", "disabled", "error", err)
+		return
+	}
+	watcher.OnConfigChange(func(event fsnotify.Event) {
+		fresh := viper.New()
+		if err := loadStashConfig(fresh, configPath); err != nil {
+			logger.Log("config", "stash", "reload", "rejected", "error", err)
+			return
+		}
+		if problems := object.ValidateSettings(fresh); len(problems) > 0 {
+			for _, problem := range problems {
+				logger.Log("config", "stash", "reload", "rejected", "problem", problem.String())
+			}
+			return
+		}
+		object.SetSettings(fresh)
+		logger.Log("config", "stash", "reload", "applied")
+	})
+	watcher.WatchConfig()
+}
 
-	viper.AutomaticEnv()
-	viper.SetEnvPrefix("stash")
-	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+// initCredentials builds the credentials provider shared by all signers. The
+// secrets file wins over the environment, which wins over the config files.
+func initCredentials(configPath string) credentials.Provider {
+	var providers []credentials.Provider
+	if secretsFile := viper.GetString("credentials.secrets_file"); len(secretsFile) > 0 {
+		providers = append(providers, credentials.NewSecretsFileProvider(secretsFile))
+	}
+	providers = append(providers,
+		credentials.NewEnvProvider(viper.GetString("credentials.env_prefix")),
+		credentials.NewConfigProvider(configPath),
+	)
+	return credentials.Chain(providers...)
 }
 
-func initDB() *gorm.DB {
+// initDB opens the MySQL connection configured by mysql.dsn and migrates all
+// models. It returns nil when no DSN is configured, in which case the server
+// runs in token-only mode.
+func initDB(logger log.Logger) *gorm.DB {
 	mysqlDSN := viper.GetString("mysql.dsn")
+	if len(mysqlDSN) == 0 {
+		logger.Log("warning", "no mysql.dsn configured, running in token-only mode")
+		return nil
+	}
+
 	db, err := gorm.Open("mysql", mysqlDSN)
 	if err != nil {
 		panic(err)
 	}
 
+	sqlDB := db.DB()
+	if n := viper.GetInt("mysql.max_open_conns"); n > 0 {
+		sqlDB.SetMaxOpenConns(n)
+	}
+	if n := viper.GetInt("mysql.max_idle_conns"); n > 0 {
+		sqlDB.SetMaxIdleConns(n)
+	}
+	if d := viper.GetInt("mysql.conn_max_lifetime"); d > 0 {
+		sqlDB.SetConnMaxLifetime(time.Second * time.Duration(d))
+	}
+
 	err = db.AutoMigrate(model.AllModels()...).Error
 	if err != nil {
 		panic(err)
@@ -44,6 +134,31 @@ func initDB() *gorm.DB {
 	return db
 }
 
+// validateConfig implements the validate-config subcommand: it prints every
+// problem in qiniu.toml and stash.toml and returns the process exit code.
+func validateConfig(configPath string, logger log.Logger) int {
+	problems, err := object.ValidateConfig(configPath, logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot load config from %s: %s\n", configPath, err)
+		return 2
+	}
+	stash := viper.New()
+	if err := loadStashConfig(stash, configPath); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot load config from %s: %s\n", configPath, err)
+		return 2
+	}
+	problems = append(problems, object.ValidateSettings(stash)...)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "%d problem(s) in %s\n", len(problems), configPath)
+		return 1
+	}
+	fmt.Printf("%s: ok\n", configPath)
+	return 0
+}
+
 func main() {
 	var logger log.Logger
 	logger = log.NewJSONLogger(os.Stderr)
@@ -56,41 +171,159 @@ func main() {
 		logger.Log("warning", "no STASH_CONFIG_PATH in env, use default")
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "validate-config" {
+		if len(os.Args) > 2 {
+			configPath = os.Args[2]
+		}
+		os.Exit(validateConfig(configPath, logger))
+	}
+
 	logger.Log("configPath", configPath)
 
 	initConfig(configPath)
+	if problems := object.ValidateSettings(viper.GetViper()); len(problems) > 0 {
+		for _, problem := range problems {
+			logger.Log("config", "stash", "problem", problem.String())
+		}
+		if viper.GetBool("strict_config") {
+			panic(fmt.Errorf("stash config has %d problem(s)", len(problems)))
+		}
+	}
+	// Requests read their own copy of stash.toml, see object.SetSettings;
+	// the global viper is only read here in main.
+	objectSettings := viper.New()
+	if err := loadStashConfig(objectSettings, configPath); err != nil {
+		panic(err)
+	}
+	object.SetSettings(objectSettings)
+	if viper.GetBool("watch_config") {
+		watchConfig(configPath, logger)
+	}
+
+	// A nil db means token-only mode: DB-backed endpoints answer 503.
+	db := initDB(logger)
+	if db != nil {
+		defer db.Close()
+		fmt.Println("done: make database connection")
+	}
 
-	// Do not use database.
-	// db := initDB()
-	// defer db.Close()
-	// fmt.Println("done: make database connection")
-	var db *gorm.DB
+	creds := initCredentials(configPath)
 
-	// Create service.
-	service, err := object.NewService(db, logger, configPath)
+	// Create services.
+	var verifierConfig callback.UserVerifierConfig
+	if err := viper.UnmarshalKey("callback.user_verifier", &verifierConfig); err != nil {
+		panic(err)
+	}
+	if len(verifierConfig.Type) == 0 {
+		logger.Log("warning", "no callback.user_verifier configured, all put-object callbacks and user-scoped secrets will be rejected")
+	}
+	verifier, err := callback.NewUserVerifier(verifierConfig)
 	if err != nil {
 		panic(err)
 	}
-	handler := object.MakeHTTPHandler(service, logger)
+	objectService, err := object.NewService(db, logger, configPath, creds, verifier)
+	if err != nil {
+		panic(err)
+	}
+	var pfopStatus callback.PfopStatusFetcher
+	if viper.GetBool("callback.qiniu.confirm_pfop") {
+		pfopStatus = callback.NewPfopStatusFetcher(creds, viper.GetString("callback.qiniu.key_id"))
+	}
+	callbackService := callback.NewService(db, logger, verifier, creds, pfopStatus)
+
+	var ossSignatureConfig callback.OssSignatureConfig
+	if err := viper.UnmarshalKey("callback.oss", &ossSignatureConfig); err != nil {
+		panic(err)
+	}
+	if !ossSignatureConfig.VerifySignature {
+		logger.Log("warning", "callback.oss.verify_signature is off, OSS callbacks are not authenticated")
+	}
+	ossVerifier := callback.NewOssSignatureVerifier(ossSignatureConfig)
 
 	fmt.Println("done: create service")
 
 	// Create URL routing.
+	checks := health.New(time.Second*time.Duration(viper.GetInt("server.readiness_timeout")), logger)
+	checks.AddCheck("object", func(ctx context.Context) error {
+		if err := objectService.CheckReadiness(ctx); err != nil {
+			return err
+		}
+		return nil
+	})
+	healthHandler := checks.MakeHTTPHandler()
+
 	mux := http.NewServeMux()
-	mux.Handle("/v1/oss/", handler)
+	mux.Handle("/healthz", healthHandler)
+	mux.Handle("/readyz", healthHandler)
+	mux.Handle("/v1/oss/", object.MakeHTTPHandler(objectService, logger))
+	mux.Handle("/v1/callback/", callback.MakeHTTPHandler(callbackService, ossVerifier, logger))
 
-	errs := make(chan error)
-	go func() {
-		c := make(chan os.Signal)
-		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-		errs <- fmt.Errorf("%s", <-c)
-	}()
+	server := &http.Server{
+		Addr:         fmt.Sprintf("%s:%d", viper.GetString("server.addr"), viper.GetInt("server.port")),
+		Handler:      mux,
+		ReadTimeout:  time.Second * time.Duration(viper.GetInt("server.read_timeout")),
+		WriteTimeout: time.Second * time.Duration(viper.GetInt("server.write_timeout")),
+		IdleTimeout:  time.Second * time.Duration(viper.GetInt("server.idle_timeout")),
+	}
 
+	drainDelay := time.Second * time.Duration(viper.GetInt("server.drain_delay"))
+	shutdownTimeout := time.Second * time.Duration(viper.GetInt("server.shutdown_timeout"))
+	errs := make(chan error, 2)
 	go func() {
-		httpAddr := fmt.Sprintf("%s:%d", viper.GetString("server.addr"), viper.GetInt("server.port"))
-		logger.Log("transport", "HTTP", "addr", httpAddr)
-		errs <- http.ListenAndServe(httpAddr, mux)
+		logger.Log("transport", "HTTP", "addr", server.Addr)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			errs <- err
+		}
 	}()
 
-	logger.Log("exit", <-errs)
+	// Admin endpoints expose key IDs and rotation state, so they are only
+	// served on their own listener, off by default.
+	var adminServer *http.Server
+	if port := viper.GetInt("server.admin_port"); port > 0 {
+		adminServer = &http.Server{
+			Addr:         fmt.Sprintf("%s:%d", viper.GetString("server.admin_addr"), port),
+			Handler:      object.MakeAdminHTTPHandler(objectService, logger),
+			ReadTimeout:  time.Second * time.Duration(viper.GetInt("server.read_timeout")),
+			WriteTimeout: time.Second * time.Duration(viper.GetInt("server.write_timeout")),
+			IdleTimeout:  time.Second * time.Duration(viper.GetInt("server.idle_timeout")),
+		}
+		go func() {
+			logger.Log("transport", "HTTP", "admin_addr", adminServer.Addr)
+			if err := adminServer.ListenAndServe(); err != http.ErrServerClosed {
+				errs <- err
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-errs:
+		logger.Log("exit", err)
+		return
+	case sig := <-signals:
+		logger.Log("signal", sig, "msg", "draining connections")
+	}
+
+	// Fail readiness first and give load balancers drain_delay to notice and
+	// stop sending new requests, then wait for in-flight requests to finish.
+	checks.Drain()
+	select {
+	case <-time.After(drainDelay):
+	case sig := <-signals:
+		logger.Log("signal", sig, "msg", "skipping drain delay")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if adminServer != nil {
+		if err := adminServer.Shutdown(ctx); err != nil {
+			logger.Log("admin", "shutdown", "error", err)
+		}
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Log("exit", err)
+		return
+	}
+	logger.Log("exit", "graceful shutdown complete")
 }
@@ -38,3 +38,39 @@ type ObjectRef struct {
 func (ObjectRef) TableName() string {
 	return "oss_ref"
 }
+
+// ProcessingJob represents a Qiniu persistent processing (pfop) job.
+type ProcessingJob struct {
+	ID           uint      `gorm:"column:id;primary_key;auto_increment"`
+	PersistentID string    `gorm:"column:persistent_id;type:varchar(64);not null;unique_index:pfop_persistent_id_unique"`
+	Bucket       string    `gorm:"column:bucket;type:varchar(64)"`
+	Key          string    `gorm:"column:key;type:varchar(128)"`
+	Pipeline     string    `gorm:"column:pipeline;type:varchar(64)"`
+	Code         int       `gorm:"column:code;not null"`
+	Desc         string    `gorm:"column:desc;type:varchar(128)"`
+	CreatedTime  time.Time `gorm:"column:created_time;type:timestamp"`
+	UpdatedTime  time.Time `gorm:"column:updated_time;type:timestamp"`
+}
+
+// TableName defines table name in database.
+func (ProcessingJob) TableName() string {
+	return "oss_pfop"
+}
+
+// ProcessingJobOp represents the result of one fop of a ProcessingJob.
+type ProcessingJobOp struct {
+	ID    uint   `gorm:"column:id;primary_key;auto_increment"`
+	JobID uint   `gorm:"column:job_id;not null;unique_index:pfop_op_job_index_unique"`
+	Index int    `gorm:"column:index;not null;unique_index:pfop_op_job_index_unique"`
+	Cmd   string `gorm:"column:cmd;type:varchar(512)"`
+	Code  int    `gorm:"column:code;not null"`
+	Desc  string `gorm:"column:desc;type:varchar(128)"`
+	Error string `gorm:"column:error;type:varchar(256)"`
+	Key   string `gorm:"column:key;type:varchar(128)"`
+	Hash  string `gorm:"column:hash;type:varchar(64)"`
+}
+
+// TableName defines table name in database.
+func (ProcessingJobOp) TableName() string {
+	return "oss_pfop_op"
+}
@@ -57,10 +57,80 @@ func DeleteObjectRef(db *gorm.DB, objRef *ObjectRef) error {
 	return err
 }
 
+// Processing job status codes, as reported by Qiniu.
+const (
+	JobCodeSucceeded    = 0
+	JobCodeWaiting      = 1
+	JobCodeProcessing   = 2
+	JobCodeFailed       = 3
+	JobCodeNotifyFailed = 4
+)
+
+// CreateProcessingJob creates a new ProcessingJob record.
+func CreateProcessingJob(db *gorm.DB, job *ProcessingJob) error {
+	return db.Create(job).Error
+}
+
+// StoreProcessingJob creates or updates the ProcessingJob with the same
+// persistent ID, replacing its ops.
+func StoreProcessingJob(db *gorm.DB, job *ProcessingJob, ops []ProcessingJobOp) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	var existing ProcessingJob
+	err := tx.Where(&ProcessingJob{PersistentID: job.PersistentID}).First(&existing).Error
+	switch {
+	case err == nil:
+		job.ID = existing.ID
+		job.CreatedTime = existing.CreatedTime
+		err = tx.Save(job).Error
+	case gorm.IsRecordNotFoundError(err):
+		err = tx.Create(job).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if ops != nil {
+		if err := tx.Where("job_id = ?", job.ID).Delete(ProcessingJobOp{}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		for i := range ops {
+			ops[i].ID = 0
+			ops[i].JobID = job.ID
+			if err := tx.Create(&ops[i]).Error; err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	return tx.Commit().Error
+}
+
+// FindProcessingJob retrieves the ProcessingJob specified by persistent ID
+// together with its ops, ordered by index.
+func FindProcessingJob(db *gorm.DB, persistentID string) (*ProcessingJob, []ProcessingJobOp, error) {
+	job := new(ProcessingJob)
+	err := db.Where(&ProcessingJob{PersistentID: persistentID}).First(job).Error
+	if err != nil {
+		return &ProcessingJob{}, nil, err
+	}
+	var ops []ProcessingJobOp
+	err = db.Where("job_id = ?", job.ID).Order("`index`").Find(&ops).Error
+	return job, ops, err
+}
+
 // AllModels retrieve a list of all model objects with empty values.
 func AllModels() []interface{} {
 	return []interface{}{
 		Object{},
 		ObjectRef{},
+		ProcessingJob{},
+		ProcessingJobOp{},
 	}
 }
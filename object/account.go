@@ -0,0 +1,184 @@
+package object
+
+// Named cloud accounts
+//
+// A deployment may use several Qiniu and Aliyun accounts, e.g. one for media
+// and one for compliance documents. Every account names the credentials key
+// ID it signs with (see package credentials) and the buckets it owns.
+// Categories and domains are bound to the account owning their bucket, or
+// to the default account, which uses the top-level key_id.
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/bluecover/qiniu_token/base"
+	"github.com/bluecover/qiniu_token/credentials"
+	"github.com/pkg/errors"
+)
+
+type qiniuAccount struct {
+	KeyID   string   `mapstructure:"key_id"`
+	Buckets []string `mapstructure:"buckets"`
+}
+
+// resolveAccounts fills in default key IDs and indexes the buckets of every
+// account. It is called by loadQiniuConfig.
+func (c *qiniuConfig) resolveAccounts() {
+	c.bucketAccount = make(map[string]string)
+	names := make([]string, 0, len(c.Account))
+	for name := range c.Account {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		account := c.Account[name]
+		if len(account.KeyID) == 0 {
+			account.KeyID = credentials.DefaultQiniuKeyID + "-" + name
+		}
+		for _, bucket := range account.Buckets {
+			if owner, ok := c.bucketAccount[bucket]; ok {
+				c.addLoadProblem(fmt.Sprintf("account.%s.buckets", name), fmt.Errorf("bucket %q already belongs to account %q", bucket, owner))
+				continue
+			}
+			c.bucketAccount[bucket] = name
+		}
+		c.Account[name] = account
+	}
+}
+
+// accountKeyID returns the key ID of the named account, or of the default
+// account when name is empty.
+func (c *qiniuConfig) accountKeyID(name string) (string, error) {
+	if len(name) == 0 {
+		return c.KeyID, nil
+	}
+	account, ok := c.Account[name]
+	if !ok {
+		return "", fmt.Errorf("unknown account %q", name)
+	}
+	return account.KeyID, nil
+}
+
+// categoryKeyID returns the key ID signing tokens for category: its explicit
+// account, else the account owning its bucket.
+func (c *qiniuConfig) categoryKeyID(category *qiniuCategory) (string, error) {
+	if len(category.Account) > 0 {
+		return c.accountKeyID(category.Account)
+	}
+	return c.accountKeyID(c.bucketAccount[category.Bucket])
+}
+
+// bucketKeyID returns the key ID signing private URLs of bucket. Buckets not
+// bound to an account, including the empty bucket of raw domains that are
+// not declared in [domain], use the default account.
+func (c *qiniuConfig) bucketKeyID(bucket string) (string, error) {
+	return c.accountKeyID(c.bucketAccount[bucket])
+}
+
+// keyIDs returns the key IDs of all accounts, the default one first.
+func (c *qiniuConfig) keyIDs() []string {
+	keyIDs := []string{c.KeyID}
+	names := make([]string, 0, len(c.Account))
+	for name := range c.Account {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		keyIDs = append(keyIDs, c.Account[name].KeyID)
+	}
+	return keyIDs
+}
+
+// aliyunAccount is the STS setup of an Aliyun account, read from stash.toml:
+// the default account from [aliyun], named ones from [aliyun.account.<name>].
+type aliyunAccount struct {
+	KeyID         string   `mapstructure:"key_id"`
+	RoleArn       string   `mapstructure:"role_arn_oss_wr"`
+	SessionName   string   `mapstructure:"session_name"`
+	TokenDuration int      `mapstructure:"token_duration"`
+	Buckets       []string `mapstructure:"buckets"`
+}
+
+// loadAliyunAccounts reads the default account and the named accounts,
+// sorted by name. Settings missing from a named account are taken from the
+// default account.
+func loadAliyunAccounts() (aliyunAccount, []aliyunAccount, *base.AppError) {
+	stash := settings()
+	account := aliyunAccount{
+		KeyID:         stash.GetString("aliyun.key_id"),
+		RoleArn:       stash.GetString("aliyun.role_arn_oss_wr"),
+		SessionName:   stash.GetString("aliyun.session_name"),
+		TokenDuration: stash.GetInt("aliyun.token_duration"),
+	}
+	if len(account.KeyID) == 0 {
+		account.KeyID = credentials.DefaultAliyunKeyID
+	}
+
+	var accounts map[string]aliyunAccount
+	if err := stash.UnmarshalKey("aliyun.account", &accounts); err != nil {
+		return aliyunAccount{}, nil, base.NewAppError(ErrCredentials, errors.Wrap(err, "aliyun.account"))
+	}
+	names := make([]string, 0, len(accounts))
+	for name := range accounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	named := make([]aliyunAccount, 0, len(names))
+	for _, name := range names {
+		a := accounts[name]
+		if len(a.KeyID) == 0 {
+			a.KeyID = credentials.DefaultAliyunKeyID + "-" + name
+		}
+		if len(a.RoleArn) == 0 {
+			a.RoleArn = account.RoleArn
+		}
+		if len(a.SessionName) == 0 {
+			a.SessionName = account.SessionName
+		}
+		if a.TokenDuration == 0 {
+			a.TokenDuration = account.TokenDuration
+		}
+		named = append(named, a)
+	}
+	return account, named, nil
+}
+
+// aliyunAccountForBucket returns the Aliyun account owning bucket.
+func aliyunAccountForBucket(bucket string) (aliyunAccount, *base.AppError) {
+	account, named, err := loadAliyunAccounts()
+	if err != nil {
+		return aliyunAccount{}, err
+	}
+	for _, a := range named {
+		if containsString(a.Buckets, bucket) {
+			return a, nil
+		}
+	}
+	return account, nil
+}
+
+// aliyunKeyIDs returns the key IDs of all Aliyun accounts, the default one
+// first.
+func aliyunKeyIDs() ([]string, *base.AppError) {
+	account, named, err := loadAliyunAccounts()
+	if err != nil {
+		return nil, err
+	}
+	keyIDs := []string{account.KeyID}
+	for _, a := range named {
+		keyIDs = append(keyIDs, a.KeyID)
+	}
+	return keyIDs, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -1,30 +1,183 @@
 package object
 
+import (
+	"fmt"
+	"sort"
+
+	"github.com/bluecover/qiniu_token/credentials"
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+)
+
 type qiniuPersistentOps struct {
+	Name       string `mapstructure:"name"`
+	Order      int    `mapstructure:"order"`
 	Pfop       string `mapstructure:"pfop"`
-	SaveBucket string `mapstructure:"save_bueket"`
+	SaveBucket string `mapstructure:"save_bucket"`
 	SaveKey    string `mapstructure:"save_key"`
+
+	// LegacySaveBucket is the misspelled key accepted by earlier releases.
+	LegacySaveBucket string `mapstructure:"save_bueket"`
+
+	pfopTemplate    *fopTemplate
+	saveKeyTemplate *fopTemplate
 }
 
 type qiniuCategory struct {
-	Bucket             string                        `mapstructure:"bucket"`
-	SaveKey            string                        `mapstructure:"save_key"`
-	Scope              string                        `mapstructure:"scope"`
-	IsPrefixalScope    int64                         `mapstructure:"is_prefixal_scope"`
-	MimeLimit          string                        `mapstructure:"mime_limit"`
-	FsizeLimit         int64                         `mapstructure:"fsize_limit"`
-	FsizeMin           int64                         `mapstructure:"fsize_min"`
-	InsertOnly         int64                         `mapstructure:"insert_only"`
-	PersistentOps      map[string]qiniuPersistentOps `mapstructure:"persistent_ops"`
-	PersistentPipeline string                        `mapstructure:"persistent_pipeline"`
-	ReturnBody         []string                      `mapstructure:"return_body"`
+	Bucket              string      `mapstructure:"bucket"`
+	SaveKey             string      `mapstructure:"save_key"`
+	Scope               string      `mapstructure:"scope"`
+	IsPrefixalScope     int64       `mapstructure:"is_prefixal_scope"`
+	MimeLimit           string      `mapstructure:"mime_limit"`
+	FsizeLimit          int64       `mapstructure:"fsize_limit"`
+	FsizeMin            int64       `mapstructure:"fsize_min"`
+	InsertOnly          int64       `mapstructure:"insert_only"`
+	RawPersistentOps    interface{} `mapstructure:"persistent_ops"`
+	PersistentPipeline  string      `mapstructure:"persistent_pipeline"`
+	PersistentNotifyURL string      `mapstructure:"persistent_notify_url"`
+	ReturnBody          []string    `mapstructure:"return_body"`
+	CallbackURL         string      `mapstructure:"callback_url"`
+	CallbackBody        string      `mapstructure:"callback_body"`
+	CallbackBodyType    string      `mapstructure:"callback_body_type"`
+	Account             string      `mapstructure:"account"`
+
+	// PersistentOps holds RawPersistentOps in the order the fops are run.
+	PersistentOps   []qiniuPersistentOps `mapstructure:"-"`
+	saveKeyTemplate *fopTemplate
 }
 
 type qiniuConfig struct {
-	AccessKey          string                   `mapstructure:"access_key"`
-	SecretKey          string                   `mapstructure:"secret_key"`
-	TokenDuration      int64                    `mapstructure:"token_duration"`
-	PrivateURLDuration int64                    `mapstructure:"private_url_duration"`
-	Domain             map[string]string        `mapstructure:"domain"`
-	Category           map[string]qiniuCategory `mapstructure:"category"`
+	KeyID               string                         `mapstructure:"key_id"`
+	AccessKey           string                         `mapstructure:"access_key"`
+	SecretKey           string                         `mapstructure:"secret_key"`
+	TokenDuration       int64                          `mapstructure:"token_duration"`
+	PrivateURLDuration  int64                          `mapstructure:"private_url_duration"`
+	PersistentNotifyURL string                         `mapstructure:"persistent_notify_url"`
+	SecretsFsizeLimit   int64                          `mapstructure:"secrets_fsize_limit"`
+	SecretsMimeLimit    string                         `mapstructure:"secrets_mime_limit"`
+	Domain              map[string]string              `mapstructure:"domain"`
+	AllowedRawDomains   []string                       `mapstructure:"allowed_raw_domains"`
+	Download            map[string]qiniuDownloadPolicy `mapstructure:"download"`
+	Style               map[string]string              `mapstructure:"style"`
+	Category            map[string]qiniuCategory       `mapstructure:"category"`
+	Account             map[string]qiniuAccount        `mapstructure:"account"`
+
+	// bucketAccount maps buckets to the name of the account owning them.
+	bucketAccount map[string]string
+	// loadProblems collects errors found while decoding, see Validate.
+	loadProblems []ConfigProblem
+}
+
+// loadQiniuConfig unmarshals qiniu.toml, orders the persistent ops of every
+// category, resolves their save buckets and parses their templates. Only
+// unreadable files are errors; everything else is reported by Validate.
+func loadQiniuConfig(v *viper.Viper, logger kitlog.Logger) (*qiniuConfig, error) {
+	var config qiniuConfig
+	if err := v.Unmarshal(&config); err != nil {
+		return nil, err
+	}
+	if len(config.KeyID) == 0 {
+		config.KeyID = credentials.DefaultQiniuKeyID
+	}
+	config.resolveAccounts()
+
+	for name, category := range config.Category {
+		categoryPath := "category." + name
+		ops, err := decodePersistentOps(category.RawPersistentOps)
+		if err != nil {
+			config.addLoadProblem(categoryPath+".persistent_ops", err)
+		}
+		for i := range ops {
+			path := fmt.Sprintf("%s.persistent_ops.%s", categoryPath, ops[i].Name)
+			if len(ops[i].LegacySaveBucket) > 0 {
+				logger.Log("warning", fmt.Sprintf("%s.save_bueket is deprecated, use save_bucket", path))
+			}
+			if err := resolveSaveBucket(&ops[i], config.Domain); err != nil {
+				config.addLoadProblem(path+".save_bucket", err)
+			}
+			if ops[i].pfopTemplate, err = parseTemplate(ops[i].Pfop); err != nil {
+				config.addLoadProblem(path+".pfop", err)
+			}
+			if ops[i].saveKeyTemplate, err = parseTemplate(ops[i].SaveKey); err != nil {
+				config.addLoadProblem(path+".save_key", err)
+			}
+		}
+		category.PersistentOps = ops
+
+		if category.saveKeyTemplate, err = parseTemplate(category.SaveKey); err != nil {
+			config.addLoadProblem(categoryPath+".save_key", err)
+		}
+		config.Category[name] = category
+	}
+
+	return &config, nil
+}
+
+func (c *qiniuConfig) addLoadProblem(path string, err error) {
+	c.loadProblems = append(c.loadProblems, ConfigProblem{Path: path, Message: err.Error()})
+}
+
+// resolveSaveBucket merges the legacy save_bueket key into SaveBucket and
+// checks that the bucket is declared in the [domain] section.
+func resolveSaveBucket(op *qiniuPersistentOps, domains map[string]string) error {
+	if len(op.LegacySaveBucket) > 0 {
+		if len(op.SaveBucket) > 0 && op.SaveBucket != op.LegacySaveBucket {
+			return fmt.Errorf("%q conflicts with deprecated save_bueket %q", op.SaveBucket, op.LegacySaveBucket)
+		}
+		op.SaveBucket = op.LegacySaveBucket
+	}
+	if len(op.SaveBucket) == 0 {
+		return fmt.Errorf("empty save bucket")
+	}
+	if _, ok := domains[op.SaveBucket]; !ok {
+		return fmt.Errorf("%q is not declared in [domain]", op.SaveBucket)
+	}
+	return nil
+}
+
+// decodePersistentOps accepts persistent ops either as a list
+// ([[category.x.persistent_ops]]), which keeps its order, or as a table of
+// named ops ([category.x.persistent_ops.name]), which is ordered by the
+// "order" field and then by name.
+func decodePersistentOps(raw interface{}) ([]qiniuPersistentOps, error) {
+	switch value := raw.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		ops := make([]qiniuPersistentOps, len(value))
+		for i, item := range value {
+			if err := mapstructure.Decode(item, &ops[i]); err != nil {
+				return nil, fmt.Errorf("[%d]: %s", i, err)
+			}
+			if len(ops[i].Name) == 0 {
+				ops[i].Name = fmt.Sprintf("%d", i)
+			}
+		}
+		return ops, nil
+	case []map[string]interface{}:
+		items := make([]interface{}, len(value))
+		for i, item := range value {
+			items[i] = item
+		}
+		return decodePersistentOps(items)
+	case map[string]interface{}:
+		ops := make([]qiniuPersistentOps, 0, len(value))
+		for name, item := range value {
+			var op qiniuPersistentOps
+			if err := mapstructure.Decode(item, &op); err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+			op.Name = name
+			ops = append(ops, op)
+		}
+		sort.Slice(ops, func(i, j int) bool {
+			if ops[i].Order != ops[j].Order {
+				return ops[i].Order < ops[j].Order
+			}
+			return ops[i].Name < ops[j].Name
+		})
+		return ops, nil
+	}
+	return nil, fmt.Errorf("expected a table or an array of tables, got %T", raw)
 }
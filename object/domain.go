@@ -0,0 +1,58 @@
+package object
+
+// Download domains
+//
+// GetPrivateURL signs URLs for a bucket alias from the [domain] section of
+// qiniu.toml, e.g. "image-avatar". Raw domains are only accepted when their
+// host is listed in allowed_raw_domains.
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// resolveDomain returns the download domain and bucket for a bucket alias or
+// an allow-listed raw domain. The bucket of a raw domain is the one whose
+// domain has the same host, or empty.
+func (c *qiniuConfig) resolveDomain(domain string) (string, string, error) {
+	if domainURL, ok := c.Domain[domain]; ok {
+		return domainURL, domain, nil
+	}
+
+	host := domainHost(domain)
+	if !c.isAllowedRawDomain(host) {
+		return "", "", fmt.Errorf("unknown domain %q", domain)
+	}
+	if !strings.Contains(domain, "://") {
+		domain = "http://" + domain
+	}
+	for bucket, bucketDomain := range c.Domain {
+		if domainHost(bucketDomain) == host {
+			return domain, bucket, nil
+		}
+	}
+	return domain, "", nil
+}
+
+func (c *qiniuConfig) isAllowedRawDomain(host string) bool {
+	for _, allowed := range c.AllowedRawDomains {
+		if domainHost(allowed) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// domainHost returns the lower-cased host of a domain given with or without
+// a scheme.
+func domainHost(domain string) string {
+	if !strings.Contains(domain, "://") {
+		domain = "http://" + domain
+	}
+	u, err := url.Parse(domain)
+	if err != nil {
+		return strings.ToLower(domain)
+	}
+	return strings.ToLower(u.Host)
+}
@@ -0,0 +1,190 @@
+package object
+
+// Download policies for private URLs
+//
+// A [download.<bucket>] table in qiniu.toml limits the private URLs signed
+// for a bucket alias of the [domain] section:
+//
+//     max_lifetime = 300                 # seconds, default private_url_duration
+//     allow_attname = true               # accept a download file name
+//     allowed_fops = ["imageView2"]      # image processing commands accepted
+//
+// Requests may ask for a shorter lifetime, never a longer one. Buckets
+// without a table get private_url_duration and neither attname nor fops.
+// Fops must not contain query syntax (&?=#) or whitespace, which would add
+// parameters such as attname or e past the policy.
+//
+// Instead of a raw fop, requests may name a style from the [style] table,
+// e.g. thumbnail = "imageView2/2/w/200/h/200". Its commands must be allowed
+// by the policy as well.
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bluecover/qiniu_token/base"
+	"github.com/pkg/errors"
+	"github.com/qiniu/api.v7/auth/qbox"
+)
+
+type qiniuDownloadPolicy struct {
+	MaxLifetime  int64    `mapstructure:"max_lifetime"`
+	AllowAttname bool     `mapstructure:"allow_attname"`
+	AllowedFops  []string `mapstructure:"allowed_fops"`
+}
+
+// downloadPolicy returns the policy of bucket, with defaults filled in.
+func (c *qiniuConfig) downloadPolicy(bucket string) qiniuDownloadPolicy {
+	policy := c.Download[bucket]
+	if policy.MaxLifetime <= 0 {
+		policy.MaxLifetime = c.PrivateURLDuration
+	}
+	return policy
+}
+
+// resolveFop returns the fop of the requested style, or the raw fop.
+func (c *qiniuConfig) resolveFop(options PrivateURLOptions) (string, error) {
+	if len(options.Style) == 0 {
+		return options.Fop, nil
+	}
+	if len(options.Fop) > 0 {
+		return "", fmt.Errorf("style and fop are mutually exclusive")
+	}
+	fop, ok := c.Style[options.Style]
+	if !ok {
+		return "", fmt.Errorf("unknown style %q", options.Style)
+	}
+	return fop, nil
+}
+
+// lifetime returns the lifetime of a URL asked to live requested seconds,
+// 0 meaning as long as allowed.
+func (p qiniuDownloadPolicy) lifetime(requested int64) (int64, error) {
+	if requested < 0 {
+		return 0, fmt.Errorf("negative expires %d", requested)
+	}
+	if requested == 0 || requested > p.MaxLifetime {
+		return p.MaxLifetime, nil
+	}
+	return requested, nil
+}
+
+// query builds the query of a private URL from the requested fop and
+// attname, rejecting what the policy does not allow.
+func (p qiniuDownloadPolicy) query(fop string, attname string) (string, error) {
+	var parts []string
+	if len(fop) > 0 {
+		if err := checkFopSyntax(fop); err != nil {
+			return "", err
+		}
+		for _, name := range fopCommands(fop) {
+			if !containsString(p.AllowedFops, name) {
+				return "", fmt.Errorf("image processing %q is not allowed", name)
+			}
+		}
+		parts = append(parts, fop)
+	}
+	if len(attname) > 0 {
+		if !p.AllowAttname {
+			return "", fmt.Errorf("attname is not allowed")
+		}
+		parts = append(parts, "attname="+url.QueryEscape(attname))
+	}
+	return strings.Join(parts, "&"), nil
+}
+
+// qiniuURLSigner signs private URLs against one config snapshot and clock
+// reading, looking up the mac of every account once.
+type qiniuURLSigner struct {
+	impl   *serviceImpl
+	config *qiniuConfig
+	now    time.Time
+	macs   map[string]*qbox.Mac
+}
+
+func (impl *serviceImpl) newQiniuURLSigner() *qiniuURLSigner {
+	return &qiniuURLSigner{
+		impl:   impl,
+		config: impl.currentQiniuConfig(),
+		now:    time.Now(),
+		macs:   make(map[string]*qbox.Mac),
+	}
+}
+
+// sign signs key under the bucket alias or raw domain within its download
+// policy.
+func (s *qiniuURLSigner) sign(domain string, key string, options PrivateURLOptions) (PrivateURL, *base.AppError) {
+	if len(domain) == 0 || len(key) == 0 {
+		return PrivateURL{}, base.NewAppError(ErrInvalidParameter, fmt.Errorf("empty domain or key"))
+	}
+	domainURL, bucket, err := s.config.resolveDomain(domain)
+	if err != nil {
+		return PrivateURL{}, base.NewAppError(ErrInvalidParameter, err)
+	}
+	policy := s.config.downloadPolicy(bucket)
+	duration, err := policy.lifetime(options.Expires)
+	if err != nil {
+		return PrivateURL{}, base.NewAppError(ErrInvalidParameter, err)
+	}
+	fop, err := s.config.resolveFop(options)
+	if err != nil {
+		return PrivateURL{}, base.NewAppError(ErrInvalidParameter, err)
+	}
+	query, err := policy.query(fop, options.Attname)
+	if err != nil {
+		return PrivateURL{}, base.NewAppError(ErrInvalidParameter, err)
+	}
+	keyID, err := s.config.bucketKeyID(bucket)
+	if err != nil {
+		return PrivateURL{}, base.NewAppError(ErrCredentials, errors.Wrap(err, domain))
+	}
+	mac, ok := s.macs[keyID]
+	if !ok {
+		var appErr *base.AppError
+		if mac, appErr = s.impl.qiniuMac(keyID); appErr != nil {
+			return PrivateURL{}, appErr
+		}
+		s.macs[keyID] = mac
+	}
+	deadline := s.now.Add(time.Second * time.Duration(duration))
+	return makeQiniuPrivateURL(mac, domainURL, key, query, deadline), nil
+}
+
+// checkFopSyntax rejects a fop that would escape its place in the query.
+func checkFopSyntax(fop string) error {
+	for _, r := range fop {
+		if strings.ContainsRune("&?=#", r) || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return fmt.Errorf("invalid character %q in image processing %q", r, fop)
+		}
+	}
+	return nil
+}
+
+// fopCommands returns the command names of a "|" separated fop pipeline,
+// e.g. ["imageView2", "imageMogr2"].
+func fopCommands(fop string) []string {
+	var names []string
+	for _, cmd := range strings.Split(fop, "|") {
+		names = append(names, strings.SplitN(cmd, "/", 2)[0])
+	}
+	return names
+}
+
+// makeQiniuPrivateURL signs domain/key?query until deadline. The key is
+// escaped, so it cannot smuggle in a query of its own.
+func makeQiniuPrivateURL(mac *qbox.Mac, domain string, key string, query string, deadline time.Time) PrivateURL {
+	u := strings.TrimRight(domain, "/") + "/" + (&url.URL{Path: key}).EscapedPath()
+	if len(query) > 0 {
+		u += "?" + query + "&"
+	} else {
+		u += "?"
+	}
+	u += fmt.Sprintf("e=%d", deadline.Unix())
+	return PrivateURL{
+		URL:        u + "&token=" + mac.Sign([]byte(u)),
+		Expiration: deadline.UTC(),
+	}
+}
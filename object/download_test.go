@@ -0,0 +1,39 @@
+package object
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDownloadPolicyQuery(t *testing.T) {
+	policy := qiniuDownloadPolicy{AllowedFops: []string{"imageView2", "imageMogr2"}}
+	tests := []struct {
+		fop     string
+		attname string
+		query   string
+		err     string
+	}{
+		{fop: "imageView2/2/w/200", query: "imageView2/2/w/200"},
+		{fop: "imageView2/2/w/200|imageMogr2/blur/20x5", query: "imageView2/2/w/200|imageMogr2/blur/20x5"},
+		{fop: "watermark/1/image/aHR0cA", err: "not allowed"},
+		{fop: "imageView2/2/w/200&attname=evil.html", err: "invalid character"},
+		{fop: "imageView2/2/w/200&e=9999999999", err: "invalid character"},
+		{fop: "imageView2/2/w/200?x", err: "invalid character"},
+		{fop: "imageView2/2/w/200#x", err: "invalid character"},
+		{fop: "imageView2/2/w/200 x", err: "invalid character"},
+		{fop: "imageView2/2/w/200\nx", err: "invalid character"},
+		{attname: "a.jpg", err: "attname is not allowed"},
+	}
+	for _, test := range tests {
+		query, err := policy.query(test.fop, test.attname)
+		if len(test.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("query(%q, %q) = %q, %v; want error %q", test.fop, test.attname, query, err, test.err)
+			}
+			continue
+		}
+		if err != nil || query != test.query {
+			t.Errorf("query(%q, %q) = %q, %v; want %q", test.fop, test.attname, query, err, test.query)
+		}
+	}
+}
@@ -6,48 +6,56 @@ import (
 	"github.com/bluecover/qiniu_token/base"
 	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/log"
-	"github.com/spf13/viper"
 )
 
 // Endpoints collects all of the endpoints that compose a Object service.
 type Endpoints struct {
 	GetUploadTokenEndpoint        endpoint.Endpoint
 	GetPrivateURLEndpoint         endpoint.Endpoint
+	GetPrivateURLsEndpoint        endpoint.Endpoint
 	GetAccessSecretsEndpoint      endpoint.Endpoint
 	AddObjectReferenceEndPoint    endpoint.Endpoint
 	RemoveObjectReferenceEndPoint endpoint.Endpoint
 	GetObjectEndpoint             endpoint.Endpoint
 	GetAllObjectsEndpoint         endpoint.Endpoint
 	DeleteObjectEndpoint          endpoint.Endpoint
+	GetProcessingJobEndpoint      endpoint.Endpoint
+	GetActiveKeysEndpoint         endpoint.Endpoint
 }
 
 // MakeServerEndpoints returns an Endpoints struct where each endpoint invokes
 // the corresponding method on the provided service.
 func MakeServerEndpoints(s Service, logger log.Logger) Endpoints {
 	var (
-		debug = viper.GetBool("debug")
+		debug = settings().GetBool("debug")
 	)
 	if debug {
 		return Endpoints{
 			GetUploadTokenEndpoint:        LoggingMiddleware(log.With(logger, "method", "GetUploadToken"))(MakeGetUploadTokenEndpoint(s)),
 			GetAccessSecretsEndpoint:      LoggingMiddleware(log.With(logger, "method", "GetAccessSecrets"))(MakeGetAccessSecretsEndpoint(s)),
 			GetPrivateURLEndpoint:         LoggingMiddleware(log.With(logger, "method", "GetPrivateURL"))(MakeGetPrivateURLEndpoint(s)),
+			GetPrivateURLsEndpoint:        LoggingMiddleware(log.With(logger, "method", "GetPrivateURLs"))(MakeGetPrivateURLsEndpoint(s)),
 			AddObjectReferenceEndPoint:    LoggingMiddleware(log.With(logger, "method", "AddObjectReference"))(MakeAddObjectReferenceEndPoint(s)),
 			RemoveObjectReferenceEndPoint: LoggingMiddleware(log.With(logger, "method", "RemoveObjectReference"))(MakeRemoveObjectReferenceEndPoint(s)),
 			GetObjectEndpoint:             LoggingMiddleware(log.With(logger, "method", "GetObjec"))(MakeGetObjectEndpoint(s)),
 			GetAllObjectsEndpoint:         LoggingMiddleware(log.With(logger, "method", "GetAllObjects"))(MakeGetAllObjectsEndpoint(s)),
 			DeleteObjectEndpoint:          LoggingMiddleware(log.With(logger, "method", "DeleteObject"))(MakeDeleteObjectEndpoint(s)),
+			GetProcessingJobEndpoint:      LoggingMiddleware(log.With(logger, "method", "GetProcessingJob"))(MakeGetProcessingJobEndpoint(s)),
+			GetActiveKeysEndpoint:         LoggingMiddleware(log.With(logger, "method", "GetActiveKeys"))(MakeGetActiveKeysEndpoint(s)),
 		}
 	}
 	return Endpoints{
 		GetUploadTokenEndpoint:        MakeGetUploadTokenEndpoint(s),
 		GetAccessSecretsEndpoint:      MakeGetAccessSecretsEndpoint(s),
 		GetPrivateURLEndpoint:         MakeGetPrivateURLEndpoint(s),
+		GetPrivateURLsEndpoint:        MakeGetPrivateURLsEndpoint(s),
 		AddObjectReferenceEndPoint:    MakeAddObjectReferenceEndPoint(s),
 		RemoveObjectReferenceEndPoint: MakeRemoveObjectReferenceEndPoint(s),
 		GetObjectEndpoint:             MakeGetObjectEndpoint(s),
 		GetAllObjectsEndpoint:         MakeGetAllObjectsEndpoint(s),
 		DeleteObjectEndpoint:          MakeDeleteObjectEndpoint(s),
+		GetProcessingJobEndpoint:      MakeGetProcessingJobEndpoint(s),
+		GetActiveKeysEndpoint:         MakeGetActiveKeysEndpoint(s),
 	}
 }
 
@@ -55,6 +63,7 @@ type getUploadTokenRequest struct {
 	Cloud    string `json:"cloud"`
 	Category string `json:"category"`
 	User     string `json:"user"`
+	Options  string `json:"options"`
 }
 
 type getUploadTokenResponse struct {
@@ -69,7 +78,7 @@ func (r getUploadTokenResponse) error() *base.AppError { return r.Err }
 func MakeGetUploadTokenEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(getUploadTokenRequest)
-		token, err := s.GetUploadToken(ctx, req.Cloud, req.Category, req.User)
+		token, err := s.GetUploadToken(ctx, req.Cloud, req.Category, req.User, req.Options)
 		return getUploadTokenResponse{
 			Data:   token,
 			Status: base.SuccessStatus,
@@ -79,9 +88,10 @@ func MakeGetUploadTokenEndpoint(s Service) endpoint.Endpoint {
 }
 
 type getPrivateURLRequest struct {
-	Cloud  string `json:"cloud"`
-	Domain string `json:"domain"`
-	Key    string `json:"key"`
+	Cloud   string            `json:"cloud"`
+	Domain  string            `json:"domain"`
+	Key     string            `json:"key"`
+	Options PrivateURLOptions `json:"options"`
 }
 
 type getPrivateURLResponseData struct {
@@ -100,7 +110,7 @@ func (r getPrivateURLResponse) error() *base.AppError { return r.Err }
 func MakeGetPrivateURLEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(getPrivateURLRequest)
-		url, err := s.GetPrivateURL(ctx, req.Cloud, req.Domain, req.Key)
+		url, err := s.GetPrivateURL(ctx, req.Cloud, req.Domain, req.Key, req.Options)
 		return getPrivateURLResponse{
 			Data:   getPrivateURLResponseData{URL: url},
 			Status: base.SuccessStatus,
@@ -109,6 +119,36 @@ func MakeGetPrivateURLEndpoint(s Service) endpoint.Endpoint {
 	}
 }
 
+type getPrivateURLsRequest struct {
+	Cloud string           `json:"cloud"`
+	Items []PrivateURLItem `json:"items"`
+}
+
+type getPrivateURLsResponseData struct {
+	URLs []PrivateURLResult `json:"urls"`
+}
+
+type getPrivateURLsResponse struct {
+	Data   getPrivateURLsResponseData `json:"data"`
+	Status base.Status                `json:"status"`
+	Err    *base.AppError             `json:"-"`
+}
+
+func (r getPrivateURLsResponse) error() *base.AppError { return r.Err }
+
+// MakeGetPrivateURLsEndpoint returns an endpoint via the passed service.
+func MakeGetPrivateURLsEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(getPrivateURLsRequest)
+		urls, err := s.GetPrivateURLs(ctx, req.Cloud, req.Items)
+		return getPrivateURLsResponse{
+			Data:   getPrivateURLsResponseData{URLs: urls},
+			Status: base.SuccessStatus,
+			Err:    err,
+		}, nil
+	}
+}
+
 type getAccessSecretsRequest struct {
 	Cloud   string `json:"cloud"`
 	Bucket  string `json:"bucket"`
@@ -261,3 +301,56 @@ func MakeDeleteObjectEndpoint(s Service) endpoint.Endpoint {
 		return deleteObjectResponse{Status: base.SuccessStatus, Err: e}, nil
 	}
 }
+
+type getProcessingJobRequest struct {
+	PersistentID string `json:"persistentId"`
+}
+
+type getProcessingJobResponseData struct {
+	Job ProcessingJobInfo `json:"job"`
+}
+
+type getProcessingJobResponse struct {
+	Data   getProcessingJobResponseData `json:"data"`
+	Status base.Status                  `json:"status"`
+	Err    *base.AppError               `json:"-"`
+}
+
+func (r getProcessingJobResponse) error() *base.AppError { return r.Err }
+
+// MakeGetProcessingJobEndpoint returns an endpoint via the passed service.
+func MakeGetProcessingJobEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(getProcessingJobRequest)
+		job, err := s.GetProcessingJob(ctx, req.PersistentID)
+		return getProcessingJobResponse{
+			Data:   getProcessingJobResponseData{Job: job},
+			Status: base.SuccessStatus,
+			Err:    err,
+		}, nil
+	}
+}
+
+type getActiveKeysResponseData struct {
+	Keys []KeyStatus `json:"keys"`
+}
+
+type getActiveKeysResponse struct {
+	Data   getActiveKeysResponseData `json:"data"`
+	Status base.Status               `json:"status"`
+	Err    *base.AppError            `json:"-"`
+}
+
+func (r getActiveKeysResponse) error() *base.AppError { return r.Err }
+
+// MakeGetActiveKeysEndpoint returns an endpoint via the passed service.
+func MakeGetActiveKeysEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		keys, err := s.GetActiveKeys(ctx)
+		return getActiveKeysResponse{
+			Data:   getActiveKeysResponseData{Keys: keys},
+			Status: base.SuccessStatus,
+			Err:    err,
+		}, nil
+	}
+}
@@ -0,0 +1,216 @@
+package object
+
+// Per-request token options
+//
+// The upload token and secrets endpoints take an optional "options"
+// parameter, base64url encoded JSON:
+//
+//     {"duration": 600, "key_prefix": "drafts/", "max_size": 1048576,
+//      "content_type": "image/*", "read_only": true, "user": "42",
+//      "user_token": "<token>"}
+//
+// Options only narrow what the server would issue anyway: duration and
+// max_size are capped by the configured token_duration and fsize_limit,
+// content_type must fall within the category's mime_limit, and key_prefix is
+// appended to the configured key prefix. Any other field must be a string
+// and becomes the ${opt.<name>} template variable.
+//
+// user, which scopes credentials to the user's keys, is an app user ID that
+// must come with a user_token accepted by [callback.user_verifier].
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	tokenOptionDuration    = "duration"
+	tokenOptionReadOnly    = "read_only"
+	tokenOptionKeyPrefix   = "key_prefix"
+	tokenOptionMaxSize     = "max_size"
+	tokenOptionContentType = "content_type"
+	tokenOptionUser        = "user"
+	tokenOptionUserToken   = "user_token"
+)
+
+// decodeTokenOptions decodes and validates base64url encoded JSON options;
+// empty input means no options.
+func decodeTokenOptions(optionsJSONString string) (TokenOptions, error) {
+	options := TokenOptions{Vars: make(map[string]string)}
+	if len(optionsJSONString) == 0 {
+		return options, nil
+	}
+	content, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(optionsJSONString, "="))
+	if err != nil {
+		return options, errors.Wrap(err, "base64")
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return options, errors.Wrap(err, "json")
+	}
+
+	for name, value := range fields {
+		var target interface{}
+		switch name {
+		case tokenOptionDuration:
+			target = &options.Duration
+		case tokenOptionReadOnly:
+			target = &options.ReadOnly
+		case tokenOptionKeyPrefix:
+			target = &options.KeyPrefix
+		case tokenOptionMaxSize:
+			target = &options.MaxSize
+		case tokenOptionContentType:
+			target = &options.ContentType
+		case tokenOptionUser:
+			target = &options.User
+		case tokenOptionUserToken:
+			target = &options.UserToken
+		default:
+			if !templateOptionName.MatchString(name) {
+				return options, fmt.Errorf("invalid option name %q", name)
+			}
+			var s string
+			if err := json.Unmarshal(value, &s); err != nil {
+				return options, fmt.Errorf("option %q must be a string", name)
+			}
+			options.Vars[name] = s
+			continue
+		}
+		decoder := json.NewDecoder(bytes.NewReader(value))
+		if err := decoder.Decode(target); err != nil {
+			return options, fmt.Errorf("invalid %s: %s", name, value)
+		}
+	}
+	return options, options.validate()
+}
+
+func (o TokenOptions) validate() error {
+	if o.Duration < 0 {
+		return fmt.Errorf("%s must not be negative", tokenOptionDuration)
+	}
+	if o.MaxSize < 0 {
+		return fmt.Errorf("%s must not be negative", tokenOptionMaxSize)
+	}
+	if len(o.KeyPrefix) > 0 {
+		if strings.HasPrefix(o.KeyPrefix, "/") || strings.ContainsAny(o.KeyPrefix, "*?") {
+			return fmt.Errorf("invalid %s %q", tokenOptionKeyPrefix, o.KeyPrefix)
+		}
+		for _, segment := range strings.Split(o.KeyPrefix, "/") {
+			if segment == "." || segment == ".." {
+				return fmt.Errorf("invalid %s %q", tokenOptionKeyPrefix, o.KeyPrefix)
+			}
+		}
+	}
+	if len(o.ContentType) > 0 && !mimeTypePattern.MatchString(o.ContentType) {
+		return fmt.Errorf("invalid %s %q", tokenOptionContentType, o.ContentType)
+	}
+	return nil
+}
+
+// forUpload rejects the options that only apply to credentials.
+func (o TokenOptions) forUpload() error {
+	if o.ReadOnly {
+		return fmt.Errorf("%s does not apply to upload tokens", tokenOptionReadOnly)
+	}
+	if len(o.User) > 0 {
+		return fmt.Errorf("%s does not apply to upload tokens", tokenOptionUser)
+	}
+	if len(o.UserToken) > 0 {
+		return fmt.Errorf("%s does not apply to upload tokens", tokenOptionUserToken)
+	}
+	return nil
+}
+
+// forCredentials rejects the options that only apply to upload tokens.
+func (o TokenOptions) forCredentials() error {
+	if o.MaxSize > 0 {
+		return fmt.Errorf("%s does not apply to credentials", tokenOptionMaxSize)
+	}
+	if len(o.ContentType) > 0 {
+		return fmt.Errorf("%s does not apply to credentials", tokenOptionContentType)
+	}
+	return nil
+}
+
+// duration returns the requested duration capped by the configured one.
+func (o TokenOptions) duration(configured int64) int64 {
+	if o.Duration > 0 && (configured <= 0 || o.Duration < configured) {
+		return o.Duration
+	}
+	return configured
+}
+
+// sizeLimit returns the requested max_size capped by the configured limit,
+// 0 meaning no limit, and checks it against the configured minimum.
+func (o TokenOptions) sizeLimit(fsizeMin int64, fsizeLimit int64) (int64, error) {
+	limit := fsizeLimit
+	if o.MaxSize > 0 && (fsizeLimit <= 0 || o.MaxSize < fsizeLimit) {
+		limit = o.MaxSize
+	}
+	if limit > 0 && limit < fsizeMin {
+		return 0, fmt.Errorf("%s %d is below the minimum size %d", tokenOptionMaxSize, limit, fsizeMin)
+	}
+	return limit, nil
+}
+
+// mimeLimit returns the requested content_type if mimeLimit, in Qiniu
+// mimeLimit syntax, allows it, or mimeLimit when none was requested.
+func (o TokenOptions) mimeLimit(mimeLimit string) (string, error) {
+	if len(o.ContentType) == 0 {
+		return mimeLimit, nil
+	}
+	if len(mimeLimit) > 0 && !mimeLimitCovers(mimeLimit, o.ContentType) {
+		return "", fmt.Errorf("%s %q is not within %q", tokenOptionContentType, o.ContentType, mimeLimit)
+	}
+	return o.ContentType, nil
+}
+
+// mimeLimitCovers reports whether every media type matching contentType
+// also matches mimeLimit.
+func mimeLimitCovers(mimeLimit string, contentType string) bool {
+	negated := strings.HasPrefix(mimeLimit, "!")
+	for _, pattern := range strings.Split(strings.TrimPrefix(mimeLimit, "!"), ";") {
+		if negated {
+			// A wildcard may overlap an excluded type.
+			if strings.Contains(contentType, "*") || mimeTypeMatches(pattern, contentType) {
+				return false
+			}
+		} else if mimeTypeMatches(pattern, contentType) {
+			return true
+		}
+	}
+	return negated
+}
+
+// mimeTypeMatches reports whether pattern, such as "image/*", matches
+// contentType, which may itself be a pattern.
+func mimeTypeMatches(pattern string, contentType string) bool {
+	switch {
+	case pattern == contentType, pattern == "*/*":
+		return true
+	case strings.HasSuffix(pattern, "/*"):
+		return strings.HasPrefix(contentType, strings.TrimSuffix(pattern, "*"))
+	}
+	return false
+}
+
+// contentTypeCondition returns the POST policy condition limiting the
+// Content-Type form field to mimeLimit, nil for no limit. Policies express a
+// single media type or "<type>/*" only.
+func contentTypeCondition(mimeLimit string) (interface{}, error) {
+	switch {
+	case len(mimeLimit) == 0, mimeLimit == "*/*":
+		return nil, nil
+	case strings.ContainsAny(mimeLimit, "!;"):
+		return nil, fmt.Errorf("mime_limit %q must be a single media type", mimeLimit)
+	case strings.HasSuffix(mimeLimit, "/*"):
+		return []interface{}{"starts-with", "$Content-Type", strings.TrimSuffix(mimeLimit, "*")}, nil
+	}
+	return []interface{}{"eq", "$Content-Type", mimeLimit}, nil
+}
@@ -0,0 +1,218 @@
+package object
+
+// Aliyun OSS PostObject policies
+//
+// For cloud=aliyun, GetUploadToken returns a signed PostObject policy instead
+// of STS credentials, so web clients can upload a form straight to OSS.
+// Categories are declared in stash.toml:
+//
+//     [aliyun.category.<name>]
+//     bucket = "<bucket>"                       # see [aliyun.bucket.<bucket>]
+//     save_key = "${user}/${year}/${month}/"    # key prefix, see template.go
+//     fsize_min = 1024
+//     fsize_limit = 6291456
+//     mime_limit = "image/*"                    # one media type or "<type>/*"
+//     token_duration = 600                      # default aliyun.token_duration
+//     callback_url = "https://<api host>/v1/callback/oss-put-object"
+//     callback_body = ""                        # default ossDefaultCallbackBody
+//
+// Uploads must add the x:app_user_token custom variable (callback-var form
+// field), which the callback service checks against the user.
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bluecover/qiniu_token/base"
+	"github.com/pkg/errors"
+)
+
+// ossMaxObjectSize is the largest object PostObject accepts, 5 GB.
+const ossMaxObjectSize = 5 << 30
+
+// ossDefaultCallbackBody is sent to callback_url when a category does not
+// declare its own callback_body; it matches callback.OssCallbackParam.
+// {{category}} and {{user}} are replaced by JSON strings.
+const ossDefaultCallbackBody = `{"bucket":${bucket},"object":${object},"etag":${etag},"size":${size},` +
+	`"imageInfo.format":${imageInfo.format},"imageInfo.width":${imageInfo.width},"imageInfo.height":${imageInfo.height},` +
+	`"appBusiness":{{category}},"appUserID":{{user}},"appUserToken":${x:app_user_token}}`
+
+type aliyunCategory struct {
+	Bucket           string `mapstructure:"bucket"`
+	SaveKey          string `mapstructure:"save_key"`
+	FsizeMin         int64  `mapstructure:"fsize_min"`
+	FsizeLimit       int64  `mapstructure:"fsize_limit"`
+	MimeLimit        string `mapstructure:"mime_limit"`
+	TokenDuration    int64  `mapstructure:"token_duration"`
+	CallbackURL      string `mapstructure:"callback_url"`
+	CallbackBody     string `mapstructure:"callback_body"`
+	CallbackBodyType string `mapstructure:"callback_body_type"`
+}
+
+// OssPostObject holds the form fields of an OSS PostObject upload. Key must
+// start with KeyPrefix; Callback is empty when no callback is configured.
+type OssPostObject struct {
+	Host        string `json:"host"`
+	AccessKeyID string `json:"accessKeyId"`
+	Policy      string `json:"policy"`
+	Signature   string `json:"signature"`
+	KeyPrefix   string `json:"keyPrefix"`
+	Callback    string `json:"callback,omitempty"`
+}
+
+type ossCallback struct {
+	CallbackURL      string `json:"callbackUrl"`
+	CallbackBody     string `json:"callbackBody"`
+	CallbackBodyType string `json:"callbackBodyType"`
+}
+
+func (impl *serviceImpl) ossGetUploadToken(category string, user string, options TokenOptions) (UploadToken, *base.AppError) {
+	stash := settings()
+	var categoryConfig aliyunCategory
+	if !stash.IsSet("aliyun.category." + category) {
+		return UploadToken{}, base.NewAppError(ErrInvalidParameter, fmt.Errorf("unknown category: %s", category))
+	}
+	if err := stash.UnmarshalKey("aliyun.category."+category, &categoryConfig); err != nil {
+		return UploadToken{}, base.NewAppError(ErrInvalidParameter, errors.Wrap(err, category))
+	}
+	var bucketConfig aliyunBucket
+	if err := stash.UnmarshalKey("aliyun.bucket."+categoryConfig.Bucket, &bucketConfig); err != nil || len(bucketConfig.Endpoint) == 0 {
+		return UploadToken{}, base.NewAppError(ErrInvalidParameter, fmt.Errorf("no endpoint configured for bucket %q", categoryConfig.Bucket))
+	}
+
+	now := time.Now()
+	saveKeyTemplate, err := parseTemplate(categoryConfig.SaveKey)
+	if err != nil {
+		return UploadToken{}, base.NewAppError(ErrInvalidParameter, errors.Wrap(err, "save_key"))
+	}
+	keyPrefix, err := saveKeyTemplate.render(makeTemplateVars(category, user, options.Vars, now))
+	if err != nil {
+		return UploadToken{}, base.NewAppError(ErrInvalidParameter, errors.Wrap(err, "save_key"))
+	}
+	keyPrefix += options.KeyPrefix
+
+	duration := categoryConfig.TokenDuration
+	if duration <= 0 {
+		duration = stash.GetInt64("aliyun.token_duration")
+	}
+	if duration <= 0 {
+		duration = defaultOssPrivateURLDuration
+	}
+	duration = options.duration(duration)
+	expiration := now.Add(time.Second * time.Duration(duration)).UTC()
+
+	conditions, err := makePostConditions(categoryConfig.Bucket, keyPrefix, categoryConfig.FsizeMin, categoryConfig.FsizeLimit, categoryConfig.MimeLimit, options)
+	if err != nil {
+		return UploadToken{}, base.NewAppError(ErrInvalidParameter, err)
+	}
+	policyJSON, err := json.Marshal(map[string]interface{}{
+		"expiration": expiration.Format("2006-01-02T15:04:05.000Z"),
+		"conditions": conditions,
+	})
+	if err != nil {
+		return UploadToken{}, base.NewAppError(ErrInvalidParameter, errors.Wrap(err, "policy"))
+	}
+	policy := base64.StdEncoding.EncodeToString(policyJSON)
+
+	callback, appErr := makeOssCallback(categoryConfig, category, user)
+	if appErr != nil {
+		return UploadToken{}, appErr
+	}
+
+	account, appErr := aliyunAccountForBucket(categoryConfig.Bucket)
+	if appErr != nil {
+		return UploadToken{}, appErr
+	}
+	creds, err := impl.credentials.Get(account.KeyID)
+	if err != nil {
+		return UploadToken{}, base.NewAppError(ErrCredentials, errors.Wrap(err, "aliyun"))
+	}
+	mac := hmac.New(sha1.New, []byte(creds.SecretKey))
+	mac.Write([]byte(policy))
+
+	return UploadToken{
+		Bucket:     categoryConfig.Bucket,
+		Expiration: expiration,
+		PostObject: &OssPostObject{
+			Host:        "https://" + categoryConfig.Bucket + "." + bucketConfig.Endpoint,
+			AccessKeyID: creds.AccessKey,
+			Policy:      policy,
+			Signature:   base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+			KeyPrefix:   keyPrefix,
+			Callback:    callback,
+		},
+	}, nil
+}
+
+// makePostConditions returns the POST policy conditions shared by OSS and
+// S3: the bucket, the key prefix, and the size and content type limits of
+// the category narrowed by options.
+func makePostConditions(bucket string, keyPrefix string, fsizeMin int64, fsizeLimit int64, mimeLimit string, options TokenOptions) ([]interface{}, error) {
+	conditions := []interface{}{
+		map[string]string{"bucket": bucket},
+		[]interface{}{"starts-with", "$key", keyPrefix},
+	}
+	limit, err := options.sizeLimit(fsizeMin, fsizeLimit)
+	if err != nil {
+		return nil, err
+	}
+	if fsizeMin > 0 || limit > 0 {
+		if limit <= 0 {
+			limit = ossMaxObjectSize
+		}
+		conditions = append(conditions, []interface{}{"content-length-range", fsizeMin, limit})
+	}
+	mimeLimit, err = options.mimeLimit(mimeLimit)
+	if err != nil {
+		return nil, err
+	}
+	condition, err := contentTypeCondition(mimeLimit)
+	if err != nil {
+		return nil, err
+	}
+	if condition != nil {
+		conditions = append(conditions, condition)
+	}
+	return conditions, nil
+}
+
+// makeOssCallback returns the base64 callback form field of category, or ""
+// when neither the category nor aliyun.callback_url sets a callback URL.
+func makeOssCallback(categoryConfig aliyunCategory, category string, user string) (string, *base.AppError) {
+	callbackURL := categoryConfig.CallbackURL
+	if len(callbackURL) == 0 {
+		callbackURL = settings().GetString("aliyun.callback_url")
+	}
+	if len(callbackURL) == 0 {
+		return "", nil
+	}
+
+	callback := ossCallback{
+		CallbackURL:      callbackURL,
+		CallbackBody:     categoryConfig.CallbackBody,
+		CallbackBodyType: categoryConfig.CallbackBodyType,
+	}
+	if len(callback.CallbackBody) == 0 {
+		quotedCategory, _ := json.Marshal(category)
+		quotedUser, _ := json.Marshal(user)
+		callback.CallbackBody = strings.NewReplacer(
+			"{{category}}", string(quotedCategory),
+			"{{user}}", string(quotedUser),
+		).Replace(ossDefaultCallbackBody)
+		callback.CallbackBodyType = callbackBodyTypeJSON
+	}
+	if len(callback.CallbackBodyType) == 0 {
+		callback.CallbackBodyType = callbackBodyTypeForm
+	}
+
+	content, err := json.Marshal(callback)
+	if err != nil {
+		return "", base.NewAppError(ErrInvalidParameter, errors.Wrap(err, "callback"))
+	}
+	return base64.StdEncoding.EncodeToString(content), nil
+}
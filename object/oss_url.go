@@ -0,0 +1,290 @@
+package object
+
+// Aliyun OSS signed download URLs
+//
+// Private URLs of OSS buckets are signed with the long-term key of the
+// account owning the bucket (see account.go), using either the V1 query
+// signature (HMAC-SHA1) or the V4 one (OSS4-HMAC-SHA256). Buckets are
+// declared in stash.toml:
+//
+//     [aliyun.bucket.<bucket>]
+//     endpoint = "oss-cn-hangzhou.aliyuncs.com"
+//     region = "cn-hangzhou"           # required by v4
+//     signature_version = "v4"         # "v1" or "v4", default "v4"
+//     max_lifetime = 3600              # seconds, default aliyun.private_url_duration
+//
+// Requests may ask for a shorter lifetime and, with allow_attname, a download
+// name; image styles are Qiniu only.
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bluecover/qiniu_token/base"
+	"github.com/bluecover/qiniu_token/credentials"
+	"github.com/pkg/errors"
+)
+
+const (
+	ossSignatureV1 = "v1"
+	ossSignatureV4 = "v4"
+
+	ossV4Algorithm = "OSS4-HMAC-SHA256"
+	ossV4Request   = "aliyun_v4_request"
+
+	defaultOssPrivateURLDuration = 3600
+)
+
+type aliyunBucket struct {
+	Endpoint         string `mapstructure:"endpoint"`
+	Region           string `mapstructure:"region"`
+	SignatureVersion string `mapstructure:"signature_version"`
+	MaxLifetime      int64  `mapstructure:"max_lifetime"`
+	AllowAttname     bool   `mapstructure:"allow_attname"`
+}
+
+// ossURLSigner signs OSS private URLs against one clock reading, looking up
+// the credentials of every account once.
+type ossURLSigner struct {
+	impl    *serviceImpl
+	buckets map[string]aliyunBucket
+	now     time.Time
+	creds   map[string]credentials.Credentials
+}
+
+func (impl *serviceImpl) newOssURLSigner() (*ossURLSigner, *base.AppError) {
+	var buckets map[string]aliyunBucket
+	if err := settings().UnmarshalKey("aliyun.bucket", &buckets); err != nil {
+		return nil, base.NewAppError(ErrInvalidParameter, errors.Wrap(err, "aliyun.bucket"))
+	}
+	return &ossURLSigner{
+		impl:    impl,
+		buckets: buckets,
+		now:     time.Now(),
+		creds:   make(map[string]credentials.Credentials),
+	}, nil
+}
+
+// sign signs key in bucket within the bucket's limits.
+func (s *ossURLSigner) sign(bucket string, key string, options PrivateURLOptions) (PrivateURL, *base.AppError) {
+	if len(bucket) == 0 || len(key) == 0 {
+		return PrivateURL{}, base.NewAppError(ErrInvalidParameter, fmt.Errorf("empty bucket or key"))
+	}
+	config, ok := s.buckets[bucket]
+	if !ok {
+		return PrivateURL{}, base.NewAppError(ErrInvalidParameter, fmt.Errorf("unknown bucket %q", bucket))
+	}
+	if len(options.Style) > 0 || len(options.Fop) > 0 {
+		return PrivateURL{}, base.NewAppError(ErrInvalidParameter, fmt.Errorf("image styles are not supported on aliyun"))
+	}
+
+	maxLifetime := config.MaxLifetime
+	if maxLifetime <= 0 {
+		maxLifetime = settings().GetInt64("aliyun.private_url_duration")
+	}
+	if maxLifetime <= 0 {
+		maxLifetime = defaultOssPrivateURLDuration
+	}
+	policy := qiniuDownloadPolicy{MaxLifetime: maxLifetime, AllowAttname: config.AllowAttname}
+	duration, err := policy.lifetime(options.Expires)
+	if err != nil {
+		return PrivateURL{}, base.NewAppError(ErrInvalidParameter, err)
+	}
+	query := url.Values{}
+	if len(options.Attname) > 0 {
+		if !policy.AllowAttname {
+			return PrivateURL{}, base.NewAppError(ErrInvalidParameter, fmt.Errorf("attname is not allowed"))
+		}
+		query.Set("response-content-disposition", fmt.Sprintf("attachment; filename=%q", options.Attname))
+	}
+
+	creds, appErr := s.credentials(bucket)
+	if appErr != nil {
+		return PrivateURL{}, appErr
+	}
+
+	switch config.SignatureVersion {
+	case ossSignatureV1:
+		deadline := s.now.Add(time.Second * time.Duration(duration))
+		return PrivateURL{
+			URL:        signOssURLV1(creds, config.Endpoint, bucket, key, query, deadline),
+			Expiration: deadline.UTC(),
+		}, nil
+	case "", ossSignatureV4:
+		if len(config.Region) == 0 {
+			return PrivateURL{}, base.NewAppError(ErrInvalidParameter, fmt.Errorf("no region configured for bucket %q", bucket))
+		}
+		return PrivateURL{
+			URL:        signOssURLV4(creds, config.Endpoint, config.Region, bucket, key, query, s.now, duration),
+			Expiration: s.now.Add(time.Second * time.Duration(duration)).UTC(),
+		}, nil
+	}
+	return PrivateURL{}, base.NewAppError(ErrInvalidParameter, fmt.Errorf("unknown signature_version %q", config.SignatureVersion))
+}
+
+func (s *ossURLSigner) credentials(bucket string) (credentials.Credentials, *base.AppError) {
+	account, appErr := aliyunAccountForBucket(bucket)
+	if appErr != nil {
+		return credentials.Credentials{}, appErr
+	}
+	if creds, ok := s.creds[account.KeyID]; ok {
+		return creds, nil
+	}
+	creds, err := s.impl.credentials.Get(account.KeyID)
+	if err != nil {
+		return credentials.Credentials{}, base.NewAppError(ErrCredentials, errors.Wrap(err, "aliyun"))
+	}
+	s.creds[account.KeyID] = creds
+	return creds, nil
+}
+
+// signOssURLV1 signs a GET URL with the V1 query signature:
+//
+//	base64(HMAC-SHA1(secret, "GET\n\n\n<expires>\n/<bucket>/<key>[?<sub-resources>]"))
+func signOssURLV1(creds credentials.Credentials, endpoint string, bucket string, key string, query url.Values, deadline time.Time) string {
+	expires := strconv.FormatInt(deadline.Unix(), 10)
+	resource := "/" + bucket + "/" + key
+	if len(query) > 0 {
+		// Sub-resources are signed unescaped, sorted by name.
+		names := make([]string, 0, len(query))
+		for name := range query {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		parts := make([]string, 0, len(names))
+		for _, name := range names {
+			parts = append(parts, name+"="+query.Get(name))
+		}
+		resource += "?" + strings.Join(parts, "&")
+	}
+
+	mac := hmac.New(sha1.New, []byte(creds.SecretKey))
+	mac.Write([]byte("GET\n\n\n" + expires + "\n" + resource))
+
+	query.Set("OSSAccessKeyId", creds.AccessKey)
+	query.Set("Expires", expires)
+	query.Set("Signature", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	return ossObjectURL(endpoint, bucket, key) + "?" + ossCanonicalQuery(query)
+}
+
+// signOssURLV4 signs a GET URL with the V4 query signature
+// (OSS4-HMAC-SHA256), valid for duration seconds from now.
+func signOssURLV4(creds credentials.Credentials, endpoint string, region string, bucket string, key string, query url.Values, now time.Time, duration int64) string {
+	now = now.UTC()
+	date := now.Format("20060102")
+	scope := date + "/" + region + "/oss/" + ossV4Request
+
+	query.Set("x-oss-signature-version", ossV4Algorithm)
+	query.Set("x-oss-credential", creds.AccessKey+"/"+scope)
+	query.Set("x-oss-date", now.Format("20060102T150405Z"))
+	query.Set("x-oss-expires", strconv.FormatInt(duration, 10))
+
+	signature := ossV4Signature(creds.SecretKey, region, now, "GET", bucket, key, query, nil)
+	return ossObjectURL(endpoint, bucket, key) + "?" + ossCanonicalQuery(query) + "&x-oss-signature=" + signature
+}
+
+// ossV4Signature signs a method request of key in bucket with query and the
+// default signed headers, Content-Type, Content-MD5 and x-oss-*, of headers.
+// The payload is left unsigned.
+func ossV4Signature(secretKey string, region string, now time.Time, method string, bucket string, key string, query url.Values, headers map[string]string) string {
+	now = now.UTC()
+	date := now.Format("20060102")
+
+	signed := make(map[string]string)
+	for name, value := range headers {
+		name = strings.ToLower(name)
+		if name == "content-type" || name == "content-md5" || strings.HasPrefix(name, "x-oss-") {
+			signed[name] = strings.TrimSpace(value)
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + signed[name] + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		"/" + bucket + "/" + uriEncode(key, false),
+		ossCanonicalQuery(query),
+		canonicalHeaders.String(),
+		"", // additional headers, none are signed
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		ossV4Algorithm,
+		now.Format("20060102T150405Z"),
+		date + "/" + region + "/oss/" + ossV4Request,
+		hex.EncodeToString(hashedRequest[:]),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("aliyun_v4"+secretKey), date)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, "oss")
+	signingKey = hmacSHA256(signingKey, ossV4Request)
+	return hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+}
+
+// ossCanonicalQuery encodes query sorted by encoded name, with every name
+// and value URI encoded.
+func ossCanonicalQuery(query url.Values) string {
+	encoded := make(map[string]string, len(query))
+	names := make([]string, 0, len(query))
+	for name := range query {
+		encoded[uriEncode(name, true)] = name
+		names = append(names, uriEncode(name, true))
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		part := name
+		if value := query.Get(encoded[name]); len(value) > 0 {
+			part += "=" + uriEncode(value, true)
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything but unreserved characters, and
+// "/" unless encodeSlash is set, as both OSS and S3 signatures expect.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func ossObjectURL(endpoint string, bucket string, key string) string {
+	return "https://" + bucket + "." + endpoint + "/" + uriEncode(key, false)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
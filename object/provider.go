@@ -0,0 +1,255 @@
+package object
+
+// Cloud providers
+//
+// Every storage backend implements Provider and is listed in
+// providerFactories under its cloud name, the "cloud" parameter of the API.
+// Service methods look the provider up and delegate to it, so adding a
+// backend means adding a type and one registry entry. Backends embed
+// unimplementedProvider, which answers the operations they do not support
+// with ErrUnimplemented.
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bluecover/qiniu_token/base"
+	"github.com/pkg/errors"
+	"github.com/qiniu/api.v7/storage"
+)
+
+// Provider is a storage backend.
+type Provider interface {
+	// UploadToken issues a token for uploading an object of category.
+	UploadToken(ctx context.Context, category string, user string, options TokenOptions) (UploadToken, *base.AppError)
+	// PrivateURL signs a download URL of key under domain, whose meaning is
+	// up to the backend.
+	PrivateURL(ctx context.Context, domain string, key string, options PrivateURLOptions) (PrivateURL, *base.AppError)
+	// TemporaryCredentials issues short-lived credentials for bucket.
+	TemporaryCredentials(ctx context.Context, bucket string, options TokenOptions) (AccessSecrets, *base.AppError)
+	// Stat returns the properties of key in bucket.
+	Stat(ctx context.Context, bucket string, key string) (ObjectStat, *base.AppError)
+	// Delete removes key from bucket.
+	Delete(ctx context.Context, bucket string, key string) *base.AppError
+}
+
+// providerFactories creates the providers of a service, keyed by cloud name.
+var providerFactories = map[string]func(impl *serviceImpl) Provider{
+	cloudServiceQiniu:  newQiniuProvider,
+	cloudServiceAliyun: newOssProvider,
+	cloudServiceS3:     newS3Provider,
+}
+
+func newProviders(impl *serviceImpl) map[string]Provider {
+	providers := make(map[string]Provider, len(providerFactories))
+	for cloud, factory := range providerFactories {
+		providers[cloud] = factory(impl)
+	}
+	return providers
+}
+
+// provider returns the provider of cloud.
+func (impl *serviceImpl) provider(cloud string) (Provider, *base.AppError) {
+	provider, ok := impl.providers[cloud]
+	if !ok {
+		return nil, base.NewAppError(ErrUnsupportedCloundService, fmt.Errorf("%s is not supported", cloud))
+	}
+	return provider, nil
+}
+
+// privateURLBatcher is implemented by providers that sign a batch of private
+// URLs with one signer, sharing the clock reading and credential lookups.
+type privateURLBatcher interface {
+	newPrivateURLSigner() (privateURLSigner, *base.AppError)
+}
+
+// privateURLSigner signs the private URLs of one cloud.
+type privateURLSigner interface {
+	sign(domain string, key string, options PrivateURLOptions) (PrivateURL, *base.AppError)
+}
+
+// providerURLSigner signs every URL of a batch with Provider.PrivateURL.
+type providerURLSigner struct {
+	ctx      context.Context
+	provider Provider
+}
+
+func (s providerURLSigner) sign(domain string, key string, options PrivateURLOptions) (PrivateURL, *base.AppError) {
+	return s.provider.PrivateURL(s.ctx, domain, key, options)
+}
+
+func newBatchURLSigner(ctx context.Context, provider Provider) (privateURLSigner, *base.AppError) {
+	if batcher, ok := provider.(privateURLBatcher); ok {
+		return batcher.newPrivateURLSigner()
+	}
+	return providerURLSigner{ctx: ctx, provider: provider}, nil
+}
+
+// unimplementedProvider answers every operation with ErrUnimplemented.
+type unimplementedProvider struct {
+	cloud string
+}
+
+func (p unimplementedProvider) unimplemented(operation string) *base.AppError {
+	return base.NewAppError(ErrUnimplemented, fmt.Errorf("%s does not support %s", p.cloud, operation))
+}
+
+func (p unimplementedProvider) UploadToken(ctx context.Context, category string, user string, options TokenOptions) (UploadToken, *base.AppError) {
+	return UploadToken{}, p.unimplemented("upload tokens")
+}
+
+func (p unimplementedProvider) PrivateURL(ctx context.Context, domain string, key string, options PrivateURLOptions) (PrivateURL, *base.AppError) {
+	return PrivateURL{}, p.unimplemented("private URLs")
+}
+
+func (p unimplementedProvider) TemporaryCredentials(ctx context.Context, bucket string, options TokenOptions) (AccessSecrets, *base.AppError) {
+	return AccessSecrets{}, p.unimplemented("temporary credentials")
+}
+
+func (p unimplementedProvider) Stat(ctx context.Context, bucket string, key string) (ObjectStat, *base.AppError) {
+	return ObjectStat{}, p.unimplemented("stat")
+}
+
+func (p unimplementedProvider) Delete(ctx context.Context, bucket string, key string) *base.AppError {
+	return p.unimplemented("delete")
+}
+
+// qiniuProvider signs with the accounts of qiniu.toml; private URL domains
+// are bucket aliases or allowed raw domains.
+type qiniuProvider struct {
+	unimplementedProvider
+	impl *serviceImpl
+}
+
+func newQiniuProvider(impl *serviceImpl) Provider {
+	return &qiniuProvider{unimplementedProvider{cloudServiceQiniu}, impl}
+}
+
+func (p *qiniuProvider) UploadToken(ctx context.Context, category string, user string, options TokenOptions) (UploadToken, *base.AppError) {
+	return p.impl.qiniuGetUploadToken(category, user, options)
+}
+
+func (p *qiniuProvider) PrivateURL(ctx context.Context, domain string, key string, options PrivateURLOptions) (PrivateURL, *base.AppError) {
+	return p.impl.newQiniuURLSigner().sign(domain, key, options)
+}
+
+func (p *qiniuProvider) newPrivateURLSigner() (privateURLSigner, *base.AppError) {
+	return p.impl.newQiniuURLSigner(), nil
+}
+
+// TemporaryCredentials returns a prefix-scoped upload token, Qiniu having no
+// STS.
+func (p *qiniuProvider) TemporaryCredentials(ctx context.Context, bucket string, options TokenOptions) (AccessSecrets, *base.AppError) {
+	return p.impl.qiniuGetCredentials(bucket, options)
+}
+
+func (p *qiniuProvider) Stat(ctx context.Context, bucket string, key string) (ObjectStat, *base.AppError) {
+	manager, appErr := p.bucketManager(bucket)
+	if appErr != nil {
+		return ObjectStat{}, appErr
+	}
+	info, err := manager.Stat(bucket, key)
+	if err != nil {
+		return ObjectStat{}, base.NewAppError(ErrNotFound, errors.Wrap(err, "Stat"))
+	}
+	return ObjectStat{
+		Bucket:   bucket,
+		Key:      key,
+		Size:     info.Fsize,
+		Hash:     info.Hash,
+		MimeType: info.MimeType,
+		// putTime is in units of 100ns.
+		PutTime: time.Unix(0, info.PutTime*100).UTC(),
+	}, nil
+}
+
+func (p *qiniuProvider) Delete(ctx context.Context, bucket string, key string) *base.AppError {
+	manager, appErr := p.bucketManager(bucket)
+	if appErr != nil {
+		return appErr
+	}
+	if err := manager.Delete(bucket, key); err != nil {
+		return base.NewAppError(ErrUpdateFailed, errors.Wrap(err, "Delete"))
+	}
+	return nil
+}
+
+func (p *qiniuProvider) bucketManager(bucket string) (*storage.BucketManager, *base.AppError) {
+	keyID, err := p.impl.currentQiniuConfig().bucketKeyID(bucket)
+	if err != nil {
+		return nil, base.NewAppError(ErrCredentials, errors.Wrap(err, bucket))
+	}
+	mac, appErr := p.impl.qiniuMac(keyID)
+	if appErr != nil {
+		return nil, appErr
+	}
+	return storage.NewBucketManager(mac, nil), nil
+}
+
+// ossProvider serves Aliyun OSS; private URL domains are bucket names.
+type ossProvider struct {
+	unimplementedProvider
+	impl *serviceImpl
+}
+
+func newOssProvider(impl *serviceImpl) Provider {
+	return &ossProvider{unimplementedProvider{cloudServiceAliyun}, impl}
+}
+
+func (p *ossProvider) UploadToken(ctx context.Context, category string, user string, options TokenOptions) (UploadToken, *base.AppError) {
+	return p.impl.ossGetUploadToken(category, user, options)
+}
+
+func (p *ossProvider) PrivateURL(ctx context.Context, domain string, key string, options PrivateURLOptions) (PrivateURL, *base.AppError) {
+	signer, appErr := p.impl.newOssURLSigner()
+	if appErr != nil {
+		return PrivateURL{}, appErr
+	}
+	return signer.sign(domain, key, options)
+}
+
+func (p *ossProvider) newPrivateURLSigner() (privateURLSigner, *base.AppError) {
+	return p.impl.newOssURLSigner()
+}
+
+// TemporaryCredentials assumes the STS role of the account owning bucket,
+// scoped by an inline policy, see sts_policy.go.
+func (p *ossProvider) TemporaryCredentials(ctx context.Context, bucket string, options TokenOptions) (AccessSecrets, *base.AppError) {
+	scope, appErr := makeStsScope(bucket, options)
+	if appErr != nil {
+		return AccessSecrets{}, appErr
+	}
+	account, appErr := aliyunAccountForBucket(bucket)
+	if appErr != nil {
+		return AccessSecrets{}, appErr
+	}
+	creds, err := p.impl.credentials.Get(account.KeyID)
+	if err != nil {
+		return AccessSecrets{}, base.NewAppError(ErrCredentials, errors.Wrap(err, "aliyun"))
+	}
+	return p.impl.ossGetCredentials(creds, account, scope, options.User)
+}
+
+// s3Provider serves S3-compatible storage; private URL domains are bucket
+// names.
+type s3Provider struct {
+	unimplementedProvider
+	impl *serviceImpl
+}
+
+func newS3Provider(impl *serviceImpl) Provider {
+	return &s3Provider{unimplementedProvider{cloudServiceS3}, impl}
+}
+
+func (p *s3Provider) UploadToken(ctx context.Context, category string, user string, options TokenOptions) (UploadToken, *base.AppError) {
+	return p.impl.s3GetUploadToken(category, user, options)
+}
+
+func (p *s3Provider) PrivateURL(ctx context.Context, domain string, key string, options PrivateURLOptions) (PrivateURL, *base.AppError) {
+	return p.impl.newS3URLSigner().sign(domain, key, options)
+}
+
+func (p *s3Provider) newPrivateURLSigner() (privateURLSigner, *base.AppError) {
+	return p.impl.newS3URLSigner(), nil
+}
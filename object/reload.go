@@ -0,0 +1,79 @@
+package object
+
+// Hot reload of qiniu.toml
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// reloadQiniuConfig re-reads qiniu.toml and swaps it in if it is valid. An
+// unreadable or invalid file leaves the current config in place.
+func (impl *serviceImpl) reloadQiniuConfig(configPath string) {
+	qiniuViper := viper.New()
+	qiniuViper.AddConfigPath(configPath)
+	qiniuViper.SetConfigName("qiniu")
+	if err := qiniuViper.ReadInConfig(); err != nil {
+		impl.logger.Log("config", "qiniu", "reload", "rejected", "error", err)
+		return
+	}
+	newConfig, err := loadQiniuConfig(qiniuViper, impl.logger)
+	if err != nil {
+		impl.logger.Log("config", "qiniu", "reload", "rejected", "error", err)
+		return
+	}
+	if problems := newConfig.Validate(); len(problems) > 0 {
+		for _, problem := range problems {
+			impl.logger.Log("config", "qiniu", "reload", "rejected", "problem", problem.String())
+		}
+		return
+	}
+
+	oldConfig := impl.currentQiniuConfig()
+	impl.qiniuConfig.Store(newConfig)
+
+	diff := diffQiniuConfig(oldConfig, newConfig)
+	impl.logger.Log(
+		"config", "qiniu",
+		"reload", "applied",
+		"added", strings.Join(diff.added, ","),
+		"removed", strings.Join(diff.removed, ","),
+		"changed", strings.Join(diff.changed, ","),
+		"credentials_changed", diff.credentialsChanged,
+	)
+}
+
+type qiniuConfigDiff struct {
+	added              []string
+	removed            []string
+	changed            []string
+	credentialsChanged bool
+}
+
+// diffQiniuConfig compares the categories of two configs by name.
+func diffQiniuConfig(oldConfig *qiniuConfig, newConfig *qiniuConfig) qiniuConfigDiff {
+	var diff qiniuConfigDiff
+	for name, newCategory := range newConfig.Category {
+		oldCategory, ok := oldConfig.Category[name]
+		if !ok {
+			diff.added = append(diff.added, name)
+		} else if !reflect.DeepEqual(oldCategory, newCategory) {
+			diff.changed = append(diff.changed, name)
+		}
+	}
+	for name := range oldConfig.Category {
+		if _, ok := newConfig.Category[name]; !ok {
+			diff.removed = append(diff.removed, name)
+		}
+	}
+	sort.Strings(diff.added)
+	sort.Strings(diff.removed)
+	sort.Strings(diff.changed)
+	diff.credentialsChanged = oldConfig.KeyID != newConfig.KeyID ||
+		oldConfig.AccessKey != newConfig.AccessKey || oldConfig.SecretKey != newConfig.SecretKey ||
+		!reflect.DeepEqual(oldConfig.Account, newConfig.Account)
+	return diff
+}
@@ -0,0 +1,436 @@
+package object
+
+// S3-compatible storage (AWS S3, MinIO)
+//
+// Upload tokens are presigned POST policies or presigned PUT URLs, and
+// private URLs are presigned GET URLs, all signed in-tree with AWS Signature
+// Version 4. Buckets and categories are declared in stash.toml:
+//
+//     [s3]
+//     key_id = "s3"                      # see package credentials
+//     endpoint = "http://localhost:9000" # default https://s3.<region>.amazonaws.com
+//     region = "us-east-1"
+//     path_style = true                  # MinIO; virtual-hosted otherwise
+//
+//     [s3.bucket.<bucket>]
+//     endpoint, region                   # override [s3]
+//     max_lifetime = 3600                # seconds, default s3.private_url_duration
+//     allow_attname = false
+//
+//     [s3.category.<name>]
+//     bucket = "<bucket>"
+//     save_key = "${user}/${year}/${month}/"  # key prefix, see template.go
+//     upload = "post"                    # "post" (default) or "put"
+//     fsize_min = 1024                   # enforced by POST uploads only
+//     fsize_limit = 6291456
+//     mime_limit = "image/*"             # one media type or "<type>/*"
+//     token_duration = 600               # default s3.token_duration
+//
+// PUT URLs are signed for one key, the prefix followed by a random name, and
+// for an exact Content-Type header when one is requested or configured.
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bluecover/qiniu_token/base"
+	"github.com/bluecover/qiniu_token/credentials"
+	"github.com/pkg/errors"
+)
+
+const (
+	s3Algorithm = "AWS4-HMAC-SHA256"
+	s3Request   = "aws4_request"
+
+	s3UploadPost = "post"
+	s3UploadPut  = "put"
+
+	defaultS3Region   = "us-east-1"
+	defaultS3Duration = 3600
+	// s3MaxLifetime is the longest validity SigV4 presigning allows, 7 days.
+	s3MaxLifetime = 7 * 24 * 3600
+)
+
+type s3Bucket struct {
+	Endpoint     string `mapstructure:"endpoint"`
+	Region       string `mapstructure:"region"`
+	MaxLifetime  int64  `mapstructure:"max_lifetime"`
+	AllowAttname bool   `mapstructure:"allow_attname"`
+}
+
+type s3Category struct {
+	Bucket        string `mapstructure:"bucket"`
+	SaveKey       string `mapstructure:"save_key"`
+	Upload        string `mapstructure:"upload"`
+	FsizeMin      int64  `mapstructure:"fsize_min"`
+	FsizeLimit    int64  `mapstructure:"fsize_limit"`
+	MimeLimit     string `mapstructure:"mime_limit"`
+	TokenDuration int64  `mapstructure:"token_duration"`
+}
+
+// S3Upload describes a presigned S3 upload. POST uploads send Fields, a key
+// starting with KeyPrefix and the file as a multipart form to URL; PUT
+// uploads send the object body with Headers to URL, which is signed for Key.
+type S3Upload struct {
+	Method    string            `json:"method"`
+	URL       string            `json:"url"`
+	Key       string            `json:"key,omitempty"`
+	KeyPrefix string            `json:"keyPrefix,omitempty"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+}
+
+// s3Location is where requests for a bucket go.
+type s3Location struct {
+	scheme    string
+	host      string
+	pathStyle bool
+	region    string
+}
+
+// loadS3Bucket returns the settings of bucket with the [s3] defaults filled
+// in.
+func loadS3Bucket(bucket string) (s3Bucket, s3Location, *base.AppError) {
+	stash := settings()
+	// Bucket names may contain dots, so they cannot be part of a key path.
+	var buckets map[string]s3Bucket
+	if err := stash.UnmarshalKey("s3.bucket", &buckets); err != nil {
+		return s3Bucket{}, s3Location{}, base.NewAppError(ErrInvalidParameter, errors.Wrap(err, "s3.bucket"))
+	}
+	config, ok := buckets[bucket]
+	if len(bucket) == 0 || !ok {
+		return s3Bucket{}, s3Location{}, base.NewAppError(ErrInvalidParameter, fmt.Errorf("unknown bucket %q", bucket))
+	}
+
+	location := s3Location{
+		region:    config.Region,
+		pathStyle: stash.GetBool("s3.path_style"),
+	}
+	if len(location.region) == 0 {
+		location.region = stash.GetString("s3.region")
+	}
+	if len(location.region) == 0 {
+		location.region = defaultS3Region
+	}
+	endpoint := config.Endpoint
+	if len(endpoint) == 0 {
+		endpoint = stash.GetString("s3.endpoint")
+	}
+	if len(endpoint) == 0 {
+		endpoint = "https://s3." + location.region + ".amazonaws.com"
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil || len(endpointURL.Host) == 0 {
+		return s3Bucket{}, s3Location{}, base.NewAppError(ErrInvalidParameter, fmt.Errorf("invalid endpoint %q for bucket %q", endpoint, bucket))
+	}
+	location.scheme = endpointURL.Scheme
+	location.host = endpointURL.Host
+	return config, location, nil
+}
+
+// object returns the host and path of key in bucket; an empty key addresses
+// the bucket itself.
+func (l s3Location) object(bucket string, key string) (string, string) {
+	if l.pathStyle {
+		return l.host, "/" + bucket + "/" + key
+	}
+	return bucket + "." + l.host, "/" + key
+}
+
+func (impl *serviceImpl) s3Credentials() (credentials.Credentials, *base.AppError) {
+	keyID := settings().GetString("s3.key_id")
+	if len(keyID) == 0 {
+		keyID = credentials.DefaultS3KeyID
+	}
+	creds, err := impl.credentials.Get(keyID)
+	if err != nil {
+		return credentials.Credentials{}, base.NewAppError(ErrCredentials, errors.Wrap(err, "s3"))
+	}
+	return creds, nil
+}
+
+func (impl *serviceImpl) s3GetUploadToken(category string, user string, options TokenOptions) (UploadToken, *base.AppError) {
+	stash := settings()
+	var categoryConfig s3Category
+	if !stash.IsSet("s3.category." + category) {
+		return UploadToken{}, base.NewAppError(ErrInvalidParameter, fmt.Errorf("unknown category: %s", category))
+	}
+	if err := stash.UnmarshalKey("s3.category."+category, &categoryConfig); err != nil {
+		return UploadToken{}, base.NewAppError(ErrInvalidParameter, errors.Wrap(err, category))
+	}
+	_, location, appErr := loadS3Bucket(categoryConfig.Bucket)
+	if appErr != nil {
+		return UploadToken{}, appErr
+	}
+
+	now := time.Now()
+	saveKeyTemplate, err := parseTemplate(categoryConfig.SaveKey)
+	if err != nil {
+		return UploadToken{}, base.NewAppError(ErrInvalidParameter, errors.Wrap(err, "save_key"))
+	}
+	keyPrefix, err := saveKeyTemplate.render(makeTemplateVars(category, user, options.Vars, now))
+	if err != nil {
+		return UploadToken{}, base.NewAppError(ErrInvalidParameter, errors.Wrap(err, "save_key"))
+	}
+	keyPrefix += options.KeyPrefix
+
+	duration := categoryConfig.TokenDuration
+	if duration <= 0 {
+		duration = stash.GetInt64("s3.token_duration")
+	}
+	if duration <= 0 {
+		duration = defaultS3Duration
+	}
+	if duration > s3MaxLifetime {
+		duration = s3MaxLifetime
+	}
+	duration = options.duration(duration)
+
+	creds, appErr := impl.s3Credentials()
+	if appErr != nil {
+		return UploadToken{}, appErr
+	}
+
+	var upload S3Upload
+	switch categoryConfig.Upload {
+	case "", s3UploadPost:
+		upload, err = presignS3Post(creds, location, categoryConfig, keyPrefix, options, now, duration)
+	case s3UploadPut:
+		upload, err = presignS3Put(creds, location, categoryConfig, keyPrefix, options, now, duration)
+	default:
+		err = fmt.Errorf("unknown upload method %q", categoryConfig.Upload)
+	}
+	if err != nil {
+		return UploadToken{}, base.NewAppError(ErrInvalidParameter, errors.Wrap(err, category))
+	}
+
+	return UploadToken{
+		Bucket:     categoryConfig.Bucket,
+		Expiration: now.Add(time.Second * time.Duration(duration)).UTC(),
+		Presigned:  &upload,
+	}, nil
+}
+
+// presignS3Put signs a PUT of a new key under keyPrefix.
+func presignS3Put(creds credentials.Credentials, location s3Location, category s3Category, keyPrefix string, options TokenOptions, now time.Time, duration int64) (S3Upload, error) {
+	if options.MaxSize > 0 {
+		return S3Upload{}, fmt.Errorf("%s needs a post upload", tokenOptionMaxSize)
+	}
+	contentType, err := options.mimeLimit(category.MimeLimit)
+	if err != nil {
+		return S3Upload{}, err
+	}
+	headers := make(map[string]string)
+	if len(contentType) > 0 && contentType != "*/*" {
+		if strings.ContainsAny(contentType, "*;!") {
+			return S3Upload{}, fmt.Errorf("put uploads need an exact %s within %q", tokenOptionContentType, contentType)
+		}
+		headers["Content-Type"] = contentType
+	}
+	name, err := randomObjectName()
+	if err != nil {
+		return S3Upload{}, err
+	}
+	key := keyPrefix + name
+	host, path := location.object(category.Bucket, key)
+	return S3Upload{
+		Method:  "PUT",
+		URL:     presignS3URL(creds, location, "PUT", host, path, url.Values{}, headers, now, duration),
+		Key:     key,
+		Headers: headers,
+	}, nil
+}
+
+// presignS3Post signs a POST policy limiting the key to keyPrefix and the
+// size and content type to the category's limits narrowed by options.
+func presignS3Post(creds credentials.Credentials, location s3Location, category s3Category, keyPrefix string, options TokenOptions, now time.Time, duration int64) (S3Upload, error) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	fields := map[string]string{
+		"x-amz-algorithm":  s3Algorithm,
+		"x-amz-credential": creds.AccessKey + "/" + s3Scope(date, location.region),
+		"x-amz-date":       now.Format("20060102T150405Z"),
+	}
+
+	conditions, err := makePostConditions(category.Bucket, keyPrefix, category.FsizeMin, category.FsizeLimit, category.MimeLimit, options)
+	if err != nil {
+		return S3Upload{}, err
+	}
+	for _, name := range []string{"x-amz-algorithm", "x-amz-credential", "x-amz-date"} {
+		conditions = append(conditions, map[string]string{name: fields[name]})
+	}
+	policyJSON, err := json.Marshal(map[string]interface{}{
+		"expiration": now.Add(time.Second * time.Duration(duration)).Format("2006-01-02T15:04:05.000Z"),
+		"conditions": conditions,
+	})
+	if err != nil {
+		return S3Upload{}, errors.Wrap(err, "policy")
+	}
+	fields["policy"] = base64.StdEncoding.EncodeToString(policyJSON)
+	fields["x-amz-signature"] = hex.EncodeToString(hmacSHA256(s3SigningKey(creds.SecretKey, date, location.region), fields["policy"]))
+
+	host, path := location.object(category.Bucket, "")
+	return S3Upload{
+		Method:    "POST",
+		URL:       location.scheme + "://" + host + path,
+		KeyPrefix: keyPrefix,
+		Fields:    fields,
+	}, nil
+}
+
+// presignS3URL signs a method request of host and path with the SigV4 query
+// signature, valid for duration seconds from now. The host header and
+// headers are signed and the payload is left unsigned.
+func presignS3URL(creds credentials.Credentials, location s3Location, method string, host string, path string, query url.Values, headers map[string]string, now time.Time, duration int64) string {
+	signed := map[string]string{"host": host}
+	for name, value := range headers {
+		signed[strings.ToLower(name)] = strings.TrimSpace(value)
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + signed[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	now = now.UTC()
+	date := now.Format("20060102")
+	query.Set("X-Amz-Algorithm", s3Algorithm)
+	query.Set("X-Amz-Credential", creds.AccessKey+"/"+s3Scope(date, location.region))
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", strconv.FormatInt(duration, 10))
+	query.Set("X-Amz-SignedHeaders", signedHeaders)
+
+	canonicalQuery := s3CanonicalQuery(query)
+	canonicalRequest := strings.Join([]string{
+		method,
+		uriEncode(path, false),
+		canonicalQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		query.Get("X-Amz-Date"),
+		s3Scope(date, location.region),
+		hex.EncodeToString(hashedRequest[:]),
+	}, "\n")
+	signature := hex.EncodeToString(hmacSHA256(s3SigningKey(creds.SecretKey, date, location.region), stringToSign))
+
+	return location.scheme + "://" + host + uriEncode(path, false) + "?" + canonicalQuery + "&X-Amz-Signature=" + signature
+}
+
+func s3Scope(date string, region string) string {
+	return date + "/" + region + "/s3/" + s3Request
+}
+
+func s3SigningKey(secretKey string, date string, region string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	return hmacSHA256(key, s3Request)
+}
+
+// s3CanonicalQuery encodes query sorted by encoded name, with every name
+// and value URI encoded and "=" kept for empty values.
+func s3CanonicalQuery(query url.Values) string {
+	encoded := make(map[string]string, len(query))
+	names := make([]string, 0, len(query))
+	for name := range query {
+		encoded[uriEncode(name, true)] = name
+		names = append(names, uriEncode(name, true))
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, name+"="+uriEncode(query.Get(encoded[name]), true))
+	}
+	return strings.Join(parts, "&")
+}
+
+func randomObjectName() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "random object name")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// s3URLSigner signs S3 private URLs against one clock reading.
+type s3URLSigner struct {
+	impl  *serviceImpl
+	now   time.Time
+	creds *credentials.Credentials
+}
+
+func (impl *serviceImpl) newS3URLSigner() *s3URLSigner {
+	return &s3URLSigner{impl: impl, now: time.Now()}
+}
+
+// sign presigns a GET of key in bucket within the bucket's limits.
+func (s *s3URLSigner) sign(bucket string, key string, options PrivateURLOptions) (PrivateURL, *base.AppError) {
+	if len(key) == 0 {
+		return PrivateURL{}, base.NewAppError(ErrInvalidParameter, fmt.Errorf("empty bucket or key"))
+	}
+	config, location, appErr := loadS3Bucket(bucket)
+	if appErr != nil {
+		return PrivateURL{}, appErr
+	}
+	if len(options.Style) > 0 || len(options.Fop) > 0 {
+		return PrivateURL{}, base.NewAppError(ErrInvalidParameter, fmt.Errorf("image styles are not supported on s3"))
+	}
+
+	maxLifetime := config.MaxLifetime
+	if maxLifetime <= 0 {
+		maxLifetime = settings().GetInt64("s3.private_url_duration")
+	}
+	if maxLifetime <= 0 {
+		maxLifetime = defaultS3Duration
+	}
+	if maxLifetime > s3MaxLifetime {
+		maxLifetime = s3MaxLifetime
+	}
+	policy := qiniuDownloadPolicy{MaxLifetime: maxLifetime, AllowAttname: config.AllowAttname}
+	duration, err := policy.lifetime(options.Expires)
+	if err != nil {
+		return PrivateURL{}, base.NewAppError(ErrInvalidParameter, err)
+	}
+	query := url.Values{}
+	if len(options.Attname) > 0 {
+		if !policy.AllowAttname {
+			return PrivateURL{}, base.NewAppError(ErrInvalidParameter, fmt.Errorf("attname is not allowed"))
+		}
+		query.Set("response-content-disposition", fmt.Sprintf("attachment; filename=%q", options.Attname))
+	}
+
+	if s.creds == nil {
+		creds, appErr := s.impl.s3Credentials()
+		if appErr != nil {
+			return PrivateURL{}, appErr
+		}
+		s.creds = &creds
+	}
+	host, path := location.object(bucket, key)
+	return PrivateURL{
+		URL:        presignS3URL(*s.creds, location, "GET", host, path, query, nil, s.now, duration),
+		Expiration: s.now.Add(time.Second * time.Duration(duration)).UTC(),
+	}, nil
+}
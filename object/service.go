@@ -9,30 +9,59 @@ import (
 
 // Service interface for service.
 type Service interface {
-	GetUploadToken(ctx context.Context, cloud string, category string, user string) (UploadToken, *base.AppError)
+	GetUploadToken(ctx context.Context, cloud string, category string, user string, options string) (UploadToken, *base.AppError)
 	GetAccessSecrets(ctx context.Context, cloud string, bucket string, options string) (AccessSecrets, *base.AppError)
-	GetPrivateURL(ctx context.Context, cloud string, domain string, key string) (PrivateURL, *base.AppError)
+	GetPrivateURL(ctx context.Context, cloud string, domain string, key string, options PrivateURLOptions) (PrivateURL, *base.AppError)
+	GetPrivateURLs(ctx context.Context, cloud string, items []PrivateURLItem) ([]PrivateURLResult, *base.AppError)
 	AddObjectReference(ctx context.Context, userID uint, tag string, objInfo ObjectInfo) *base.AppError
 	RemoveObjectReference(ctx context.Context, userID uint, objectID uint, tag string) *base.AppError
 	GetObject(ctx context.Context, id uint) (ObjectInfo, *base.AppError)
 	GetAllObjects(ctx context.Context) ([]ObjectInfo, *base.AppError)
 	DeleteObject(ctx context.Context, id uint) *base.AppError
+	GetProcessingJob(ctx context.Context, persistentID string) (ProcessingJobInfo, *base.AppError)
+	GetActiveKeys(ctx context.Context) ([]KeyStatus, *base.AppError)
+	CheckReadiness(ctx context.Context) *base.AppError
 }
 
 // UploadToken represents response data from GetUploadToken
+// For cloud=aliyun, Token is empty and PostObject holds the signed form
+// fields instead; for cloud=s3, Presigned holds the presigned upload.
 type UploadToken struct {
-	Bucket     string    `json:"bucket"`
-	Token      string    `json:"token"`
-	Expiration time.Time `json:"expiration"`
+	Bucket     string         `json:"bucket"`
+	Token      string         `json:"token"`
+	Expiration time.Time      `json:"expiration"`
+	PostObject *OssPostObject `json:"postObject,omitempty"`
+	Presigned  *S3Upload      `json:"presigned,omitempty"`
 }
 
-// AccessSecrets represents response data from GetAccessSecrets
+// AccessSecrets represents response data from GetAccessSecrets. Scoped
+// credentials are limited to keys starting with KeyPrefix in Bucket. For
+// cloud=qiniu, the access key fields are empty and Token is an upload token
+// for new keys under KeyPrefix.
 type AccessSecrets struct {
 	CloudService    string    `json:"cloudService"`
 	AccessKeyID     string    `json:"accessKeyId"`
 	AccessKeySecret string    `json:"accessKeySecret"`
 	Token           string    `json:"token"`
 	Expiration      time.Time `json:"expiration"`
+	Bucket          string    `json:"bucket,omitempty"`
+	KeyPrefix       string    `json:"keyPrefix,omitempty"`
+	ReadOnly        bool      `json:"readOnly,omitempty"`
+}
+
+// TokenOptions narrow an upload token or a set of credentials within the
+// limits configured for the category or bucket, see options.go. Zero values
+// leave the configured limits in place.
+type TokenOptions struct {
+	Duration    int64
+	ReadOnly    bool
+	KeyPrefix   string
+	MaxSize     int64
+	ContentType string
+	User        string
+	UserToken   string
+	// Vars holds the remaining options, the ${opt.<name>} template variables.
+	Vars map[string]string
 }
 
 // PrivateURL represents response data from GetPrivateURL
@@ -41,6 +70,43 @@ type PrivateURL struct {
 	Expiration time.Time `json:"expiration"`
 }
 
+// PrivateURLOptions narrows a private URL within the download policy of its
+// bucket. Expires is the requested lifetime in seconds, 0 for the longest
+// allowed; Style names an image style from the config, or Fop gives an image
+// processing suffix such as "imageView2/2/w/200"; Attname is the file name
+// offered when downloading.
+type PrivateURLOptions struct {
+	Expires int64  `json:"expires"`
+	Style   string `json:"style"`
+	Fop     string `json:"fop"`
+	Attname string `json:"attname"`
+}
+
+// PrivateURLItem is one entry of a GetPrivateURLs batch.
+type PrivateURLItem struct {
+	Domain string `json:"domain"`
+	Key    string `json:"key"`
+	PrivateURLOptions
+}
+
+// PrivateURLResult is the outcome of one PrivateURLItem. URL is nil when
+// Status reports an error.
+type PrivateURLResult struct {
+	URL    *PrivateURL `json:"url,omitempty"`
+	Status base.Status `json:"status"`
+}
+
+// ObjectStat represents the properties of a stored object as reported by
+// its cloud provider.
+type ObjectStat struct {
+	Bucket   string    `json:"bucket"`
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	Hash     string    `json:"hash"`
+	MimeType string    `json:"mimeType"`
+	PutTime  time.Time `json:"putTime"`
+}
+
 // ObjectInfo represents properties of a object
 type ObjectInfo struct {
 	Cloud    string `json:"cloud"`
@@ -52,6 +118,48 @@ type ObjectInfo struct {
 	Status   int    `json:"status"`
 }
 
+// ProcessingJobInfo represents the status of a persistent processing job.
+// Code is 0 on success, 1 waiting, 2 processing, 3 failed, 4 notify failed.
+type ProcessingJobInfo struct {
+	PersistentID string             `json:"persistentId"`
+	Bucket       string             `json:"bucket"`
+	Key          string             `json:"key"`
+	Pipeline     string             `json:"pipeline"`
+	Code         int                `json:"code"`
+	Desc         string             `json:"desc"`
+	UpdatedTime  time.Time          `json:"updatedTime"`
+	Ops          []ProcessingOpInfo `json:"ops"`
+}
+
+// ProcessingOpInfo represents the status and output of one persistent op.
+type ProcessingOpInfo struct {
+	Cmd   string `json:"cmd"`
+	Code  int    `json:"code"`
+	Desc  string `json:"desc"`
+	Error string `json:"error,omitempty"`
+	Key   string `json:"key,omitempty"`
+	Hash  string `json:"hash,omitempty"`
+}
+
+// KeyStatus reports which key of a credentials key ID signs new tokens.
+// Active is "primary", "secondary", or empty when no key is valid.
+type KeyStatus struct {
+	Cloud     string   `json:"cloud"`
+	KeyID     string   `json:"keyId"`
+	Active    string   `json:"active"`
+	Primary   KeyInfo  `json:"primary"`
+	Secondary *KeyInfo `json:"secondary,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// KeyInfo describes one key pair of a key ID; the secret key is never shown.
+type KeyInfo struct {
+	AccessKey  string     `json:"accessKey"`
+	ActivateAt *time.Time `json:"activateAt,omitempty"`
+	ExpireAt   *time.Time `json:"expireAt,omitempty"`
+	Valid      bool       `json:"valid"`
+}
+
 type errorer interface {
 	error() *base.AppError
 }
@@ -67,5 +175,9 @@ var (
 	ErrUpdateFailed             = "update failed"
 	ErrAliyunSTS                = "aliyun STS error"
 	ErrModelOperation           = "model operation error"
+	ErrDatabaseUnavailable      = "database unavailable"
+	ErrNotReady                 = "not ready"
+	ErrCredentials              = "credentials unavailable"
+	ErrUserVerificationFailed   = "user verification failed"
 	ErrUnknown                  = "unknown error"
 )
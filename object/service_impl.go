@@ -3,14 +3,18 @@ package object
 import (
 	"context"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/aliyun/aliyun-sts-go-sdk/sts"
 	"github.com/bluecover/qiniu_token/base"
+	"github.com/bluecover/qiniu_token/callback"
+	"github.com/bluecover/qiniu_token/credentials"
 	"github.com/bluecover/qiniu_token/model"
+	"github.com/fsnotify/fsnotify"
 	kitlog "github.com/go-kit/kit/log"
 	"github.com/jinzhu/gorm"
 	"github.com/pkg/errors"
@@ -22,11 +26,20 @@ import (
 type serviceImpl struct {
 	db          *gorm.DB
 	logger      kitlog.Logger
-	qiniuConfig *qiniuConfig
+	credentials credentials.Provider
+	verifier    callback.UserVerifier
+	providers   map[string]Provider
+	stsCache    *stsCache
+
+	// qiniuConfig holds the current *qiniuConfig, swapped on reload.
+	qiniuConfig atomic.Value
 }
 
-// NewService creates a Object service with necessary dependencies.
-func NewService(db *gorm.DB, logger kitlog.Logger, configPath string) (Service, error) {
+// NewService creates a Object service with necessary dependencies. Every
+// signer looks up its access keys in creds; verifier checks the user that
+// scopes temporary credentials.
+func NewService(db *gorm.DB, logger kitlog.Logger, configPath string, creds credentials.Provider, verifier callback.UserVerifier) (Service, error) {
+	stash := settings()
 	var qiniuViper = viper.New()
 	qiniuViper.AddConfigPath(configPath)
 	qiniuViper.SetConfigName("qiniu")
@@ -34,39 +47,67 @@ func NewService(db *gorm.DB, logger kitlog.Logger, configPath string) (Service,
 		return &serviceImpl{}, err
 	}
 
-	var qiniuConfig qiniuConfig
-	if err := qiniuViper.Unmarshal(&qiniuConfig); err != nil {
+	qiniuConfig, err := loadQiniuConfig(qiniuViper, logger)
+	if err != nil {
 		return &serviceImpl{}, err
 	}
+	if problems := qiniuConfig.Validate(); len(problems) > 0 {
+		for _, problem := range problems {
+			logger.Log("config", "qiniu", "problem", problem.String())
+		}
+		if stash.GetBool("strict_config") {
+			return &serviceImpl{}, fmt.Errorf("qiniu config has %d problem(s)", len(problems))
+		}
+	}
 
-	return &serviceImpl{
+	impl := &serviceImpl{
 		db:          db,
 		logger:      logger,
-		qiniuConfig: &qiniuConfig,
-	}, nil
+		credentials: creds,
+		verifier:    verifier,
+		stsCache:    newStsCache(logger),
+	}
+	impl.providers = newProviders(impl)
+	impl.qiniuConfig.Store(qiniuConfig)
+
+	if stash.GetBool("watch_config") {
+		qiniuViper.OnConfigChange(func(event fsnotify.Event) {
+			impl.reloadQiniuConfig(configPath)
+		})
+		qiniuViper.WatchConfig()
+	}
+
+	return impl, nil
+}
+
+// currentQiniuConfig returns the qiniu config in effect. Callers should read
+// it once per request so that a concurrent reload is seen consistently.
+func (impl *serviceImpl) currentQiniuConfig() *qiniuConfig {
+	return impl.qiniuConfig.Load().(*qiniuConfig)
+}
+
+// requireDB reports an error when the service runs in token-only mode.
+func (impl *serviceImpl) requireDB() *base.AppError {
+	if impl.db == nil {
+		return base.NewAppError(ErrDatabaseUnavailable, fmt.Errorf("no database configured, running in token-only mode"))
+	}
+	return nil
 }
 
 const (
 	cloudServiceQiniu  = "qiniu"
 	cloudServiceAliyun = "aliyun"
+	cloudServiceS3     = "s3"
 )
 
-func decodeTokenOptions(optionsJSONString string) (map[string]interface{}, error) {
-	var options map[string]interface{}
-	content, err := base64.URLEncoding.DecodeString(optionsJSONString)
-	if err != nil {
-		return map[string]interface{}{}, err
-	}
-	err = json.Unmarshal(content, &options)
-	if err != nil {
-		return map[string]interface{}{}, err
-	}
-	return options, nil
-}
+// defaultQiniuCallbackBody is sent to callback_url when a category does not
+// declare its own callback_body. The form encoding keeps the body covered by
+// the QBox callback signature.
+const defaultQiniuCallbackBody = "bucket=$(bucket)&key=$(key)&etag=$(etag)&fsize=$(fsize)&mimeType=$(mimeType)&endUser=$(endUser)&persistentId=$(persistentId)"
 
 func getQiniuBucketFromCategory(category string) (string, error) {
 	var (
-		qiniuCategory2Bucket = viper.GetStringMapString("qiniu.bucket.category")
+		qiniuCategory2Bucket = settings().GetStringMapString("qiniu.bucket.category")
 	)
 	bucket, ok := qiniuCategory2Bucket[category]
 	if !ok {
@@ -75,30 +116,38 @@ func getQiniuBucketFromCategory(category string) (string, error) {
 	return bucket, nil
 }
 
-func qiniuGetPrivateURL(domain string, key string, duration int) PrivateURL {
-	var (
-		qiniuAccessKey = viper.GetString("qiniu.access_key")
-		qiniuSecretKey = viper.GetString("qiniu.secret_key")
-	)
-	mac := qbox.NewMac(qiniuAccessKey, qiniuSecretKey)
-	deadline := time.Now().Add(time.Second * time.Duration(duration))
-	url := storage.MakePrivateURL(mac, domain, key, deadline.Unix())
-	return PrivateURL{
-		URL:        url,
-		Expiration: deadline.UTC(),
+// qiniuMac returns the Qiniu signer for keyID.
+func (impl *serviceImpl) qiniuMac(keyID string) (*qbox.Mac, *base.AppError) {
+	creds, err := impl.credentials.Get(keyID)
+	if err != nil {
+		return nil, base.NewAppError(ErrCredentials, errors.Wrap(err, "qiniu"))
 	}
+	return qbox.NewMac(creds.AccessKey, creds.SecretKey), nil
 }
 
-func ossGetCredentials(bucket string, duration uint) (AccessSecrets, *base.AppError) {
-	var (
-		accessKeyID     = viper.GetString("aliyun.access_key_id")
-		accessKeySecret = viper.GetString("aliyun.access_key_secret")
-		roleArn         = viper.GetString("aliyun.role_arn_oss_wr")
-		sessionName     = viper.GetString("aliyun.session_name")
-	)
+// ossGetCredentials assumes the STS role of account for user, limited to
+// scope, or returns cached credentials of an earlier identical call, see
+// sts_cache.go.
+func (impl *serviceImpl) ossGetCredentials(creds credentials.Credentials, account aliyunAccount, scope stsScope, user string) (AccessSecrets, *base.AppError) {
+	policy, err := scope.policy()
+	if err != nil {
+		return AccessSecrets{}, base.NewAppError(ErrInvalidParameter, err)
+	}
+	duration := int64(account.TokenDuration)
+	if scope.Duration > 0 && scope.Duration < duration {
+		duration = scope.Duration
+	}
+	key := stsCacheKey(creds.AccessKey, account.RoleArn, policy, user, duration)
+	return impl.stsCache.get(key, func() (AccessSecrets, *base.AppError) {
+		return ossAssumeRole(creds, account, scope, policy, duration)
+	})
+}
 
-	stsClient := sts.NewClient(accessKeyID, accessKeySecret, roleArn, sessionName)
-	resp, err := stsClient.AssumeRole(duration)
+// ossAssumeRole assumes the STS role of account with the inline policy of
+// scope for duration seconds.
+func ossAssumeRole(creds credentials.Credentials, account aliyunAccount, scope stsScope, policy string, duration int64) (AccessSecrets, *base.AppError) {
+	stsClient := sts.NewClient(creds.AccessKey, creds.SecretKey, account.RoleArn, account.SessionName)
+	resp, err := stsClient.AssumeRoleWithPolicy(uint(duration), policy)
 	if err != nil {
 		return AccessSecrets{}, base.NewAppError(ErrAliyunSTS, errors.Wrap(err, "sts:AssumeRole"))
 	}
@@ -109,23 +158,113 @@ func ossGetCredentials(bucket string, duration uint) (AccessSecrets, *base.AppEr
 		AccessKeySecret: resp.Credentials.AccessKeySecret,
 		Token:           resp.Credentials.SecurityToken,
 		Expiration:      resp.Credentials.Expiration.UTC(),
+		Bucket:          scope.Bucket,
+		KeyPrefix:       scope.KeyPrefix,
+		ReadOnly:        scope.ReadOnly,
 	}, nil
 }
 
-func (impl *serviceImpl) GetUploadToken(ctx context.Context, cloud string, category string, user string) (UploadToken, *base.AppError) {
-	categoryConfig, ok := impl.qiniuConfig.Category[category]
+func (impl *serviceImpl) GetUploadToken(ctx context.Context, cloud string, category string, user string, optionsJSON string) (UploadToken, *base.AppError) {
+	provider, appErr := impl.provider(cloud)
+	if appErr != nil {
+		return UploadToken{}, appErr
+	}
+	options, err := decodeTokenOptions(optionsJSON)
+	if err == nil {
+		err = options.forUpload()
+	}
+	if err != nil {
+		return UploadToken{}, base.NewAppError(ErrInvalidParameter, errors.Wrap(err, "options"))
+	}
+	return provider.UploadToken(ctx, category, user, options)
+}
+
+// qiniuGetCredentials issues the Qiniu counterpart of STS credentials: an
+// upload token for any new key of bucket under "<user>/" and the key_prefix
+// option, the user having been verified by GetAccessSecrets. Uploads are
+// capped by secrets_fsize_limit and secrets_mime_limit, as categories cap
+// upload tokens; without a size cap no token is issued. Qiniu cannot
+// delegate download signing, so read-only requests are refused; clients sign
+// downloads with GetPrivateURL instead.
+func (impl *serviceImpl) qiniuGetCredentials(bucket string, options TokenOptions) (AccessSecrets, *base.AppError) {
+	if options.ReadOnly {
+		return AccessSecrets{}, base.NewAppError(ErrUnimplemented, fmt.Errorf("qiniu has no read-only credentials, use private URLs"))
+	}
+	if len(options.User) == 0 {
+		return AccessSecrets{}, base.NewAppError(ErrMissingParameter, fmt.Errorf("%s option", tokenOptionUser))
+	}
+	config := impl.currentQiniuConfig()
+	if _, ok := config.Domain[bucket]; !ok {
+		return AccessSecrets{}, base.NewAppError(ErrInvalidParameter, fmt.Errorf("unknown bucket %q", bucket))
+	}
+	if config.SecretsFsizeLimit <= 0 {
+		return AccessSecrets{}, base.NewAppError(ErrUnimplemented, fmt.Errorf("no secrets_fsize_limit configured for qiniu"))
+	}
+	keyID, err := config.bucketKeyID(bucket)
+	if err != nil {
+		return AccessSecrets{}, base.NewAppError(ErrCredentials, errors.Wrap(err, bucket))
+	}
+	mac, appErr := impl.qiniuMac(keyID)
+	if appErr != nil {
+		return AccessSecrets{}, appErr
+	}
+
+	keyPrefix := options.User + "/" + options.KeyPrefix
+	duration := options.duration(config.TokenDuration)
+	putPolicy := storage.PutPolicy{
+		Scope:           bucket + ":" + keyPrefix,
+		IsPrefixalScope: 1,
+		InsertOnly:      1,
+		EndUser:         options.User,
+		FsizeLimit:      config.SecretsFsizeLimit,
+		MimeLimit:       config.SecretsMimeLimit,
+		Expires:         uint32(duration),
+	}
+	return AccessSecrets{
+		CloudService: cloudServiceQiniu,
+		Token:        putPolicy.UploadToken(mac),
+		Expiration:   time.Now().Add(time.Second * time.Duration(duration)).UTC(),
+		Bucket:       bucket,
+		KeyPrefix:    keyPrefix,
+	}, nil
+}
+
+func (impl *serviceImpl) qiniuGetUploadToken(category string, user string, options TokenOptions) (UploadToken, *base.AppError) {
+	config := impl.currentQiniuConfig()
+	categoryConfig, ok := config.Category[category]
 	if !ok {
 		return UploadToken{}, base.NewAppError(ErrInvalidParameter, fmt.Errorf("unknown category: %s", category))
 	}
+	if len(options.KeyPrefix) > 0 {
+		return UploadToken{}, base.NewAppError(ErrInvalidParameter, fmt.Errorf("key_prefix is not supported on qiniu, save_key decides the key"))
+	}
+	duration := options.duration(config.TokenDuration)
+	fsizeLimit, err := options.sizeLimit(categoryConfig.FsizeMin, categoryConfig.FsizeLimit)
+	if err != nil {
+		return UploadToken{}, base.NewAppError(ErrInvalidParameter, err)
+	}
+	mimeLimit, err := options.mimeLimit(categoryConfig.MimeLimit)
+	if err != nil {
+		return UploadToken{}, base.NewAppError(ErrInvalidParameter, err)
+	}
 
-	watermarkText := base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("ID:%s", user)))
-	// watermarkImage := base64.URLEncoding.EncodeToString([]byte("http://p6byep6mn.bkt.clouddn.com/watermark_26.png"))
-	// fmt.Println(watermarkImage)
+	vars := makeTemplateVars(category, user, options.Vars, time.Now())
+	saveKey, err := categoryConfig.saveKeyTemplate.render(vars)
+	if err != nil {
+		return UploadToken{}, base.NewAppError(ErrInvalidParameter, errors.Wrap(err, "save_key"))
+	}
 
 	persistentOpsList := make([]string, 0, len(categoryConfig.PersistentOps))
 	for _, ops := range categoryConfig.PersistentOps {
-		strFop := strings.Replace(ops.Pfop, "${wmText}", watermarkText, 1)
-		saveAs := fmt.Sprintf("%s:%s", ops.SaveBucket, ops.SaveKey)
+		strFop, err := ops.pfopTemplate.render(vars)
+		if err != nil {
+			return UploadToken{}, base.NewAppError(ErrInvalidParameter, errors.Wrapf(err, "persistent op %s", ops.Name))
+		}
+		opSaveKey, err := ops.saveKeyTemplate.render(vars)
+		if err != nil {
+			return UploadToken{}, base.NewAppError(ErrInvalidParameter, errors.Wrapf(err, "persistent op %s", ops.Name))
+		}
+		saveAs := fmt.Sprintf("%s:%s", ops.SaveBucket, opSaveKey)
 		b64SaveAs := base64.URLEncoding.EncodeToString([]byte(saveAs))
 		persistentOpsList = append(persistentOpsList, fmt.Sprintf("%s|saveas/%s", strFop, b64SaveAs))
 	}
@@ -147,55 +286,131 @@ func (impl *serviceImpl) GetUploadToken(ctx context.Context, cloud string, categ
 	putPolicy := storage.PutPolicy{
 		Scope:              categoryConfig.Scope,
 		IsPrefixalScope:    int(categoryConfig.IsPrefixalScope),
-		SaveKey:            categoryConfig.SaveKey,
+		SaveKey:            saveKey,
 		EndUser:            user,
 		PersistentOps:      persistentOps,
 		PersistentPipeline: categoryConfig.PersistentPipeline,
-		Expires:            uint32(impl.qiniuConfig.TokenDuration),
-		MimeLimit:          categoryConfig.MimeLimit,
-		FsizeLimit:         categoryConfig.FsizeLimit,
+		Expires:            uint32(duration),
+		MimeLimit:          mimeLimit,
+		FsizeLimit:         fsizeLimit,
 		FsizeMin:           categoryConfig.FsizeMin,
 		InsertOnly:         uint16(categoryConfig.InsertOnly),
 		ReturnBody:         returnBody,
 	}
-	mac := qbox.NewMac(impl.qiniuConfig.AccessKey, impl.qiniuConfig.SecretKey)
+	if len(persistentOps) > 0 {
+		putPolicy.PersistentNotifyURL = categoryConfig.PersistentNotifyURL
+		if len(putPolicy.PersistentNotifyURL) == 0 {
+			putPolicy.PersistentNotifyURL = config.PersistentNotifyURL
+		}
+	}
+	if len(categoryConfig.CallbackURL) > 0 {
+		putPolicy.CallbackURL = categoryConfig.CallbackURL
+		putPolicy.CallbackBody = categoryConfig.CallbackBody
+		if len(putPolicy.CallbackBody) == 0 {
+			putPolicy.CallbackBody = defaultQiniuCallbackBody
+		}
+		putPolicy.CallbackBodyType = categoryConfig.CallbackBodyType
+	}
+	keyID, err := config.categoryKeyID(&categoryConfig)
+	if err != nil {
+		return UploadToken{}, base.NewAppError(ErrCredentials, errors.Wrap(err, category))
+	}
+	mac, appErr := impl.qiniuMac(keyID)
+	if appErr != nil {
+		return UploadToken{}, appErr
+	}
 	uploadToken := putPolicy.UploadToken(mac)
 
 	return UploadToken{
 		Bucket:     categoryConfig.Bucket,
 		Token:      uploadToken,
-		Expiration: time.Now().Add(time.Second * time.Duration(impl.qiniuConfig.TokenDuration)).UTC(),
+		Expiration: time.Now().Add(time.Second * time.Duration(duration)).UTC(),
 	}, nil
 }
 
 func (impl *serviceImpl) GetAccessSecrets(ctx context.Context, cloud string, bucket string, optionsJSON string) (AccessSecrets, *base.AppError) {
-	if cloud == "aliyun" {
-		var (
-			tokenDuration = viper.GetInt("aliyun.token_duration")
-		)
-		return ossGetCredentials(bucket, uint(tokenDuration))
-	} else if cloud == "qiniu" {
-		return AccessSecrets{
-			CloudService: cloudServiceQiniu,
-			Token:        "",
-			Expiration:   time.Now().UTC(),
-		}, nil
-	} else {
-		return AccessSecrets{}, base.NewAppError(ErrUnsupportedCloundService, fmt.Errorf("%s is not supported", cloud))
+	provider, appErr := impl.provider(cloud)
+	if appErr != nil {
+		return AccessSecrets{}, appErr
 	}
+	options, err := decodeTokenOptions(optionsJSON)
+	if err == nil {
+		err = options.forCredentials()
+	}
+	if err != nil {
+		return AccessSecrets{}, base.NewAppError(ErrInvalidParameter, errors.Wrap(err, "options"))
+	}
+	if appErr := impl.verifyUser(ctx, options); appErr != nil {
+		return AccessSecrets{}, appErr
+	}
+	return provider.TemporaryCredentials(ctx, bucket, options)
+}
+
+// verifyUser checks the user option against its user_token, so that clients
+// cannot scope credentials to the keys of another user.
+func (impl *serviceImpl) verifyUser(ctx context.Context, options TokenOptions) *base.AppError {
+	if len(options.User) == 0 {
+		return nil
+	}
+	userID, err := strconv.ParseUint(options.User, 10, 0)
+	if err != nil {
+		return base.NewAppError(ErrInvalidParameter, fmt.Errorf("invalid %s %q", tokenOptionUser, options.User))
+	}
+	if len(options.UserToken) == 0 {
+		return base.NewAppError(ErrMissingParameter, fmt.Errorf("%s option", tokenOptionUserToken))
+	}
+	if err := impl.verifier.VerifyUser(ctx, uint(userID), options.UserToken); err != nil {
+		impl.logger.Log("object", "GetAccessSecrets", "user", options.User, "error", err)
+		return base.NewAppError(ErrUserVerificationFailed, errors.Wrap(err, "VerifyUser"))
+	}
+	return nil
 }
 
-func (impl *serviceImpl) GetPrivateURL(ctx context.Context, cloud string, domain string, key string) (PrivateURL, *base.AppError) {
-	if cloud == "qiniu" {
-		var (
-			privateURLDuration = viper.GetInt("qiniu.private_url_duration")
-		)
-		return qiniuGetPrivateURL(domain, key, privateURLDuration), nil
+// GetPrivateURL signs key under domain, a bucket alias for qiniu or a bucket
+// name for aliyun and s3.
+func (impl *serviceImpl) GetPrivateURL(ctx context.Context, cloud string, domain string, key string, options PrivateURLOptions) (PrivateURL, *base.AppError) {
+	provider, appErr := impl.provider(cloud)
+	if appErr != nil {
+		return PrivateURL{}, appErr
 	}
-	return PrivateURL{}, base.NewAppError(ErrUnimplemented, fmt.Errorf("GetPrivateURL"))
+	return provider.PrivateURL(ctx, domain, key, options)
+}
+
+func (impl *serviceImpl) GetPrivateURLs(ctx context.Context, cloud string, items []PrivateURLItem) ([]PrivateURLResult, *base.AppError) {
+	if limit := settings().GetInt("server.private_url_batch_limit"); len(items) > limit {
+		return make([]PrivateURLResult, 0), base.NewAppError(ErrInvalidParameter, fmt.Errorf("%d items exceed the batch limit of %d", len(items), limit))
+	}
+	provider, appErr := impl.provider(cloud)
+	if appErr != nil {
+		return make([]PrivateURLResult, 0), appErr
+	}
+	signer, appErr := newBatchURLSigner(ctx, provider)
+	if appErr != nil {
+		return make([]PrivateURLResult, 0), appErr
+	}
+
+	results := make([]PrivateURLResult, 0, len(items))
+	for _, item := range items {
+		url, err := signer.sign(item.Domain, item.Key, item.PrivateURLOptions)
+		if err != nil {
+			results = append(results, PrivateURLResult{
+				Status: base.Status{Code: err.Code, Msg: err.Err.Error()},
+			})
+			continue
+		}
+		results = append(results, PrivateURLResult{
+			URL:    &url,
+			Status: base.SuccessStatus,
+		})
+	}
+	return results, nil
 }
 
 func (impl *serviceImpl) AddObjectReference(ctx context.Context, userID uint, tag string, objInfo ObjectInfo) *base.AppError {
+	if err := impl.requireDB(); err != nil {
+		return err
+	}
+
 	obj := &model.Object{
 		Cloud:       objInfo.Cloud,
 		Bucket:      objInfo.Bucket,
@@ -242,6 +457,10 @@ func (impl *serviceImpl) AddObjectReference(ctx context.Context, userID uint, ta
 }
 
 func (impl *serviceImpl) RemoveObjectReference(ctx context.Context, userID uint, objectID uint, tag string) *base.AppError {
+	if err := impl.requireDB(); err != nil {
+		return err
+	}
+
 	err := model.DeleteObjectRef(impl.db, &model.ObjectRef{
 		UserID:   userID,
 		ObjectID: objectID,
@@ -255,6 +474,10 @@ func (impl *serviceImpl) RemoveObjectReference(ctx context.Context, userID uint,
 }
 
 func (impl *serviceImpl) GetObject(ctx context.Context, id uint) (ObjectInfo, *base.AppError) {
+	if err := impl.requireDB(); err != nil {
+		return ObjectInfo{}, err
+	}
+
 	mobj, err := model.FindObject(impl.db, id)
 	if err != nil {
 		return ObjectInfo{}, base.NewAppError(ErrNotFound, errors.Wrap(err, "FindObject"))
@@ -265,6 +488,10 @@ func (impl *serviceImpl) GetObject(ctx context.Context, id uint) (ObjectInfo, *b
 }
 
 func (impl *serviceImpl) GetAllObjects(ctx context.Context) ([]ObjectInfo, *base.AppError) {
+	if err := impl.requireDB(); err != nil {
+		return make([]ObjectInfo, 0), err
+	}
+
 	mobjcts, err := model.FindAllObjects(impl.db)
 	if err != nil {
 		return make([]ObjectInfo, 0), base.NewAppError(ErrNotFound, errors.Wrap(err, "FindAllObjects"))
@@ -279,6 +506,10 @@ func (impl *serviceImpl) GetAllObjects(ctx context.Context) ([]ObjectInfo, *base
 }
 
 func (impl *serviceImpl) DeleteObject(ctx context.Context, id uint) *base.AppError {
+	if err := impl.requireDB(); err != nil {
+		return err
+	}
+
 	err := model.DeleteObject(impl.db, id)
 	if err != nil {
 		return base.NewAppError(ErrUpdateFailed, errors.Wrap(err, "DeleteObject"))
@@ -286,6 +517,124 @@ func (impl *serviceImpl) DeleteObject(ctx context.Context, id uint) *base.AppErr
 	return nil
 }
 
+func (impl *serviceImpl) GetProcessingJob(ctx context.Context, persistentID string) (ProcessingJobInfo, *base.AppError) {
+	if err := impl.requireDB(); err != nil {
+		return ProcessingJobInfo{}, err
+	}
+
+	job, ops, err := model.FindProcessingJob(impl.db, persistentID)
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return ProcessingJobInfo{}, base.NewAppError(ErrNotFound, errors.Wrap(err, "FindProcessingJob"))
+		}
+		return ProcessingJobInfo{}, base.NewAppError(ErrModelOperation, errors.Wrap(err, "FindProcessingJob"))
+	}
+
+	info := ProcessingJobInfo{
+		PersistentID: job.PersistentID,
+		Bucket:       job.Bucket,
+		Key:          job.Key,
+		Pipeline:     job.Pipeline,
+		Code:         job.Code,
+		Desc:         job.Desc,
+		UpdatedTime:  job.UpdatedTime.UTC(),
+		Ops:          make([]ProcessingOpInfo, 0, len(ops)),
+	}
+	for _, op := range ops {
+		info.Ops = append(info.Ops, ProcessingOpInfo{
+			Cmd:   op.Cmd,
+			Code:  op.Code,
+			Desc:  op.Desc,
+			Error: op.Error,
+			Key:   op.Key,
+			Hash:  op.Hash,
+		})
+	}
+	return info, nil
+}
+
+func (impl *serviceImpl) GetActiveKeys(ctx context.Context) ([]KeyStatus, *base.AppError) {
+	stash := settings()
+	config := impl.currentQiniuConfig()
+	aliyunKeyIDs, appErr := aliyunKeyIDs()
+	if appErr != nil {
+		return make([]KeyStatus, 0), appErr
+	}
+
+	now := time.Now()
+	keys := make([]KeyStatus, 0)
+	for _, keyID := range config.keyIDs() {
+		keys = append(keys, impl.keyStatus(cloudServiceQiniu, keyID, now))
+	}
+	for _, keyID := range aliyunKeyIDs {
+		keys = append(keys, impl.keyStatus(cloudServiceAliyun, keyID, now))
+	}
+	if stash.IsSet("s3") {
+		keyID := stash.GetString("s3.key_id")
+		if len(keyID) == 0 {
+			keyID = credentials.DefaultS3KeyID
+		}
+		keys = append(keys, impl.keyStatus(cloudServiceS3, keyID, now))
+	}
+	return keys, nil
+}
+
+func (impl *serviceImpl) keyStatus(cloud string, keyID string, now time.Time) KeyStatus {
+	status := KeyStatus{Cloud: cloud, KeyID: keyID}
+	set, err := impl.credentials.KeySet(keyID)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Primary = makeKeyInfo(set.Primary, now)
+	if set.Secondary != nil {
+		secondary := makeKeyInfo(*set.Secondary, now)
+		status.Secondary = &secondary
+	}
+	if _, slot, err := set.Active(now); err != nil {
+		status.Error = err.Error()
+	} else {
+		status.Active = slot
+	}
+	return status
+}
+
+func makeKeyInfo(creds credentials.Credentials, now time.Time) KeyInfo {
+	info := KeyInfo{
+		AccessKey: creds.AccessKey,
+		Valid:     creds.ValidAt(now),
+	}
+	if !creds.ActivateAt.IsZero() {
+		activateAt := creds.ActivateAt.UTC()
+		info.ActivateAt = &activateAt
+	}
+	if !creds.ExpireAt.IsZero() {
+		expireAt := creds.ExpireAt.UTC()
+		info.ExpireAt = &expireAt
+	}
+	return info
+}
+
+func (impl *serviceImpl) CheckReadiness(ctx context.Context) *base.AppError {
+	config := impl.currentQiniuConfig()
+	if len(config.Category) == 0 {
+		return base.NewAppError(ErrNotReady, fmt.Errorf("qiniu config not loaded"))
+	}
+	for _, keyID := range config.keyIDs() {
+		if creds, err := impl.credentials.Get(keyID); err != nil {
+			return base.NewAppError(ErrNotReady, errors.Wrap(err, "qiniu"))
+		} else if len(creds.AccessKey) == 0 || len(creds.SecretKey) == 0 {
+			return base.NewAppError(ErrNotReady, fmt.Errorf("empty qiniu credentials for key id %s", keyID))
+		}
+	}
+	if impl.db != nil {
+		if err := impl.db.DB().PingContext(ctx); err != nil {
+			return base.NewAppError(ErrNotReady, errors.Wrap(err, "database ping"))
+		}
+	}
+	return nil
+}
+
 func extractModelObject(mobj *model.Object) *ObjectInfo {
 	return &ObjectInfo{
 		Cloud:    mobj.Cloud,
@@ -0,0 +1,202 @@
+package object
+
+// Settings from stash.toml
+//
+// Requests read stash.toml through settings(), not the global viper, so that
+// a reload can swap in a freshly loaded copy, checked by ValidateSettings,
+// without racing them. See SetSettings. Viper updates its maps even when
+// reading, so every read of a copy is serialized.
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/spf13/viper"
+)
+
+// stashSettings holds the current *stashConfig.
+var stashSettings atomic.Value
+
+// stashConfig serializes the reads of one stash.toml copy.
+type stashConfig struct {
+	mutex sync.Mutex
+	v     *viper.Viper
+}
+
+// SetSettings makes v the stash.toml settings seen by new requests. v must
+// not be used by the caller afterwards.
+func SetSettings(v *viper.Viper) {
+	stashSettings.Store(&stashConfig{v: v})
+}
+
+// settings returns the stash.toml settings in effect, the global viper until
+// SetSettings is called.
+func settings() *stashConfig {
+	if config, ok := stashSettings.Load().(*stashConfig); ok {
+		return config
+	}
+	return &stashConfig{v: viper.GetViper()}
+}
+
+func (c *stashConfig) IsSet(key string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.v.IsSet(key)
+}
+
+func (c *stashConfig) GetBool(key string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.v.GetBool(key)
+}
+
+func (c *stashConfig) GetInt(key string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.v.GetInt(key)
+}
+
+func (c *stashConfig) GetInt64(key string) int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.v.GetInt64(key)
+}
+
+func (c *stashConfig) GetString(key string) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.v.GetString(key)
+}
+
+func (c *stashConfig) GetStringMapString(key string) map[string]string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.v.GetStringMapString(key)
+}
+
+func (c *stashConfig) UnmarshalKey(key string, rawVal interface{}) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.v.UnmarshalKey(key, rawVal)
+}
+
+// ValidateSettings reports every problem found in the stash.toml settings
+// read by the object service.
+func ValidateSettings(v *viper.Viper) []ConfigProblem {
+	var problems []ConfigProblem
+	report := func(path string, format string, args ...interface{}) {
+		problems = append(problems, ConfigProblem{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if limit := v.GetInt("server.private_url_batch_limit"); limit <= 0 {
+		report("server.private_url_batch_limit", "must be positive, got %d", limit)
+	}
+	if callbackURL := v.GetString("aliyun.callback_url"); len(callbackURL) > 0 && !isHTTPURL(callbackURL) {
+		report("aliyun.callback_url", "%q is not an http(s) URL", callbackURL)
+	}
+	for _, key := range []string{"aliyun.sts_cache.min_remaining", "aliyun.sts_cache.refresh_remaining", "aliyun.sts_cache.max_entries"} {
+		if n := v.GetInt64(key); n < 0 {
+			report(key, "must not be negative, got %d", n)
+		}
+	}
+
+	var aliyunBuckets map[string]aliyunBucket
+	if err := v.UnmarshalKey("aliyun.bucket", &aliyunBuckets); err != nil {
+		report("aliyun.bucket", "%s", err)
+	}
+	for _, name := range sortedKeys(v.GetStringMap("aliyun.bucket")) {
+		bucket := aliyunBuckets[name]
+		path := "aliyun.bucket." + name
+		if !isHostEndpoint(bucket.Endpoint) {
+			report(path+".endpoint", "%q is not a host name such as oss-cn-hangzhou.aliyuncs.com", bucket.Endpoint)
+		}
+		switch bucket.SignatureVersion {
+		case "", ossSignatureV4:
+			if len(bucket.Region) == 0 {
+				report(path+".region", "must be set for signature_version %q", ossSignatureV4)
+			}
+		case ossSignatureV1:
+		default:
+			report(path+".signature_version", "must be %q or %q, got %q", ossSignatureV1, ossSignatureV4, bucket.SignatureVersion)
+		}
+	}
+
+	// S3 bucket names may contain dots, so buckets are looked up by name in
+	// the [s3.bucket] table rather than by key path.
+	var s3Buckets map[string]s3Bucket
+	if err := v.UnmarshalKey("s3.bucket", &s3Buckets); err != nil {
+		report("s3.bucket", "%s", err)
+	}
+	checkS3Endpoint := func(path string, endpoint string) {
+		if len(endpoint) > 0 && !isHTTPURL(endpoint) && !isHostEndpoint(endpoint) {
+			report(path, "%q is not an http(s) URL or host name", endpoint)
+		}
+	}
+	checkS3Endpoint("s3.endpoint", v.GetString("s3.endpoint"))
+	for _, name := range sortedKeys(v.GetStringMap("s3.bucket")) {
+		checkS3Endpoint(s3BucketPath(name)+".endpoint", s3Buckets[name].Endpoint)
+	}
+
+	var aliyunCategories map[string]aliyunCategory
+	if err := v.UnmarshalKey("aliyun.category", &aliyunCategories); err != nil {
+		report("aliyun.category", "%s", err)
+	}
+	for _, name := range sortedKeys(v.GetStringMap("aliyun.category")) {
+		category := aliyunCategories[name]
+		if !v.IsSet("aliyun.bucket." + category.Bucket) {
+			report("aliyun.category."+name+".bucket", "unknown bucket %q", category.Bucket)
+		}
+		if len(category.CallbackURL) > 0 && !isHTTPURL(category.CallbackURL) {
+			report("aliyun.category."+name+".callback_url", "%q is not an http(s) URL", category.CallbackURL)
+		}
+	}
+
+	var s3Categories map[string]s3Category
+	if err := v.UnmarshalKey("s3.category", &s3Categories); err != nil {
+		report("s3.category", "%s", err)
+	}
+	for _, name := range sortedKeys(v.GetStringMap("s3.category")) {
+		category := s3Categories[name]
+		if _, ok := s3Buckets[category.Bucket]; !ok {
+			report("s3.category."+name+".bucket", "unknown bucket %q", category.Bucket)
+		}
+		switch category.Upload {
+		case "", s3UploadPost, s3UploadPut:
+		default:
+			report("s3.category."+name+".upload", "must be %q or %q, got %q", s3UploadPost, s3UploadPut, category.Upload)
+		}
+	}
+	return problems
+}
+
+// s3BucketPath returns the config path of bucket, quoting dotted names as
+// TOML does.
+func s3BucketPath(bucket string) string {
+	if strings.Contains(bucket, ".") {
+		return fmt.Sprintf("s3.bucket.%q", bucket)
+	}
+	return "s3.bucket." + bucket
+}
+
+// isHostEndpoint reports whether endpoint is a bare host, with an optional
+// port, that signed URLs can be built on.
+func isHostEndpoint(endpoint string) bool {
+	if len(endpoint) == 0 || strings.ContainsAny(endpoint, "/?#@ ") {
+		return false
+	}
+	u, err := url.Parse("https://" + endpoint)
+	return err == nil && u.Host == endpoint && len(u.Hostname()) > 0
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
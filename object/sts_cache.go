@@ -0,0 +1,195 @@
+package object
+
+// Cache of STS credentials
+//
+// Credentials are cached in memory by role, inline policy, user, requested
+// duration and signing access key, so that repeated /v1/oss/secrets calls do
+// not each cost an AssumeRole round trip. Set in stash.toml:
+//
+//     [aliyun.sts_cache]
+//     min_remaining = 300     # seconds; serve while more remain, 0 disables
+//     refresh_remaining = 600 # seconds; refresh in the background below this
+//     max_entries = 10000
+//
+// Concurrent requests for the same credentials share one AssumeRole call.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluecover/qiniu_token/base"
+	kitlog "github.com/go-kit/kit/log"
+)
+
+const (
+	defaultStsCacheMinRemaining     = 300
+	defaultStsCacheRefreshRemaining = 600
+	defaultStsCacheMaxEntries       = 10000
+)
+
+type stsCacheEntry struct {
+	secrets    AccessSecrets
+	refreshing bool
+}
+
+// stsCache holds unexpired STS credentials.
+type stsCache struct {
+	logger kitlog.Logger
+	flight flightGroup
+
+	mutex   sync.Mutex
+	entries map[string]*stsCacheEntry
+}
+
+func newStsCache(logger kitlog.Logger) *stsCache {
+	return &stsCache{
+		logger:  logger,
+		entries: make(map[string]*stsCacheEntry),
+	}
+}
+
+// stsCacheKey identifies the credentials of one AssumeRole call.
+func stsCacheKey(accessKey string, roleArn string, policy string, user string, duration int64) string {
+	hash := sha256.Sum256([]byte(policy))
+	return strings.Join([]string{accessKey, roleArn, hex.EncodeToString(hash[:]), user, strconv.FormatInt(duration, 10)}, "\x00")
+}
+
+// stsCacheSettings reads the thresholds of [aliyun.sts_cache], in seconds.
+func stsCacheSettings() (minRemaining int64, refreshRemaining int64, maxEntries int) {
+	stash := settings()
+	minRemaining = defaultStsCacheMinRemaining
+	if stash.IsSet("aliyun.sts_cache.min_remaining") {
+		minRemaining = stash.GetInt64("aliyun.sts_cache.min_remaining")
+	}
+	refreshRemaining = defaultStsCacheRefreshRemaining
+	if stash.IsSet("aliyun.sts_cache.refresh_remaining") {
+		refreshRemaining = stash.GetInt64("aliyun.sts_cache.refresh_remaining")
+	}
+	maxEntries = defaultStsCacheMaxEntries
+	if stash.IsSet("aliyun.sts_cache.max_entries") {
+		maxEntries = stash.GetInt("aliyun.sts_cache.max_entries")
+	}
+	return minRemaining, refreshRemaining, maxEntries
+}
+
+// get returns the cached credentials of key while more than min_remaining
+// seconds of their lifetime are left, starting a background refresh once
+// fewer than refresh_remaining are; otherwise it waits for assume.
+func (c *stsCache) get(key string, assume func() (AccessSecrets, *base.AppError)) (AccessSecrets, *base.AppError) {
+	minRemaining, refreshRemaining, _ := stsCacheSettings()
+	if minRemaining <= 0 {
+		return assume()
+	}
+
+	now := time.Now()
+	c.mutex.Lock()
+	entry, ok := c.entries[key]
+	if ok {
+		remaining := entry.secrets.Expiration.Sub(now)
+		if remaining > time.Duration(minRemaining)*time.Second {
+			if remaining < time.Duration(refreshRemaining)*time.Second && !entry.refreshing {
+				entry.refreshing = true
+				go c.refresh(key, assume)
+			}
+			secrets := entry.secrets
+			c.mutex.Unlock()
+			return secrets, nil
+		}
+	}
+	c.mutex.Unlock()
+
+	return c.fetch(key, assume)
+}
+
+// fetch calls assume once for all concurrent callers of key and caches the
+// result.
+func (c *stsCache) fetch(key string, assume func() (AccessSecrets, *base.AppError)) (AccessSecrets, *base.AppError) {
+	value, appErr := c.flight.do(key, func() (interface{}, *base.AppError) {
+		secrets, appErr := assume()
+		if appErr != nil {
+			return nil, appErr
+		}
+		c.put(key, secrets)
+		return secrets, nil
+	})
+	if appErr != nil {
+		return AccessSecrets{}, appErr
+	}
+	return value.(AccessSecrets), nil
+}
+
+func (c *stsCache) refresh(key string, assume func() (AccessSecrets, *base.AppError)) {
+	if _, appErr := c.fetch(key, assume); appErr != nil {
+		c.logger.Log("sts_cache", "refresh", "error", appErr.Error())
+		c.mutex.Lock()
+		if entry, ok := c.entries[key]; ok {
+			// Let a later request retry.
+			entry.refreshing = false
+		}
+		c.mutex.Unlock()
+	}
+}
+
+// put stores secrets under key, first dropping expired entries when the
+// cache is full. Nothing is stored while it stays full.
+func (c *stsCache) put(key string, secrets AccessSecrets) {
+	_, _, maxEntries := stsCacheSettings()
+	now := time.Now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxEntries {
+		for k, entry := range c.entries {
+			if !entry.secrets.Expiration.After(now) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxEntries {
+			return
+		}
+	}
+	c.entries[key] = &stsCacheEntry{secrets: secrets}
+}
+
+// flightCall is a call in progress or completed by a flightGroup.
+type flightCall struct {
+	done   chan struct{}
+	value  interface{}
+	appErr *base.AppError
+}
+
+// flightGroup collapses concurrent calls with the same key into one.
+type flightGroup struct {
+	mutex sync.Mutex
+	calls map[string]*flightCall
+}
+
+// do runs fn unless a call for key is in progress, in which case it waits
+// for that call and returns its result.
+func (g *flightGroup) do(key string, fn func() (interface{}, *base.AppError)) (interface{}, *base.AppError) {
+	g.mutex.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mutex.Unlock()
+		<-call.done
+		return call.value, call.appErr
+	}
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mutex.Unlock()
+
+	defer func() {
+		g.mutex.Lock()
+		delete(g.calls, key)
+		g.mutex.Unlock()
+		close(call.done)
+	}()
+	call.value, call.appErr = fn()
+	return call.value, call.appErr
+}
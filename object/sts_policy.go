@@ -0,0 +1,129 @@
+package object
+
+// Scoped STS credentials
+//
+// Aliyun STS credentials are limited by an inline policy to one bucket, the
+// key prefix of the requesting user and either read or read-write access.
+// The prefix is a template, see template.go, set in stash.toml:
+//
+//     [aliyun]
+//     sts_key_prefix = "${user}/"        # the default
+//
+//     [aliyun.bucket.<bucket>]
+//     sts_key_prefix = "shared/${user}/" # overrides [aliyun]
+//
+// An empty sts_key_prefix grants the whole bucket. Requests name the user
+// and access in their options, see options.go: {"user": "<id>",
+// "user_token": "<token>", "read_only": true}. The user is only trusted
+// once [callback.user_verifier] accepts its token. A key_prefix option
+// narrows the prefix further and a duration option shortens the account's
+// token_duration, down to the STS minimum.
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bluecover/qiniu_token/base"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultStsKeyPrefix = "${" + templateVarUser + "}/"
+	// stsMinDuration is the shortest validity Aliyun STS accepts.
+	stsMinDuration = 900
+)
+
+var (
+	ossBucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,61}[a-z0-9]$`)
+
+	ossReadActions  = []string{"oss:GetObject", "oss:GetObjectMeta"}
+	ossWriteActions = []string{"oss:PutObject", "oss:AbortMultipartUpload", "oss:ListParts"}
+)
+
+// stsScope is what a set of STS credentials may access.
+type stsScope struct {
+	Bucket    string
+	KeyPrefix string
+	ReadOnly  bool
+	// Duration is the requested validity in seconds, 0 for the account's.
+	Duration int64
+}
+
+// makeStsScope resolves the scope of credentials for bucket from the
+// request options.
+func makeStsScope(bucket string, options TokenOptions) (stsScope, *base.AppError) {
+	stash := settings()
+	if !ossBucketName.MatchString(bucket) {
+		return stsScope{}, base.NewAppError(ErrInvalidParameter, fmt.Errorf("invalid bucket %q", bucket))
+	}
+
+	source := defaultStsKeyPrefix
+	if key := "aliyun.bucket." + bucket + ".sts_key_prefix"; stash.IsSet(key) {
+		source = stash.GetString(key)
+	} else if stash.IsSet("aliyun.sts_key_prefix") {
+		source = stash.GetString("aliyun.sts_key_prefix")
+	}
+	prefixTemplate, err := parseTemplate(source)
+	if err != nil {
+		return stsScope{}, base.NewAppError(ErrInvalidParameter, errors.Wrap(err, "sts_key_prefix"))
+	}
+	vars := makeTemplateVars("", options.User, options.Vars, time.Now())
+	if len(options.User) == 0 {
+		delete(vars, templateVarUser)
+	}
+	prefix, err := prefixTemplate.render(vars)
+	if err != nil {
+		return stsScope{}, base.NewAppError(ErrMissingParameter, errors.Wrap(err, "sts_key_prefix"))
+	}
+	prefix += options.KeyPrefix
+	// Wildcards in the prefix would widen the policy.
+	if strings.ContainsAny(prefix, "*?") {
+		return stsScope{}, base.NewAppError(ErrInvalidParameter, fmt.Errorf("invalid key prefix %q", prefix))
+	}
+
+	if options.Duration > 0 && options.Duration < stsMinDuration {
+		return stsScope{}, base.NewAppError(ErrInvalidParameter, fmt.Errorf("%s must be at least %d", tokenOptionDuration, stsMinDuration))
+	}
+	return stsScope{
+		Bucket:    bucket,
+		KeyPrefix: prefix,
+		ReadOnly:  options.ReadOnly,
+		Duration:  options.Duration,
+	}, nil
+}
+
+// policy returns the inline policy document of the scope.
+func (s stsScope) policy() (string, error) {
+	actions := append([]string{}, ossReadActions...)
+	if !s.ReadOnly {
+		actions = append(actions, ossWriteActions...)
+	}
+	list := map[string]interface{}{
+		"Effect":   "Allow",
+		"Action":   []string{"oss:ListObjects"},
+		"Resource": []string{"acs:oss:*:*:" + s.Bucket},
+	}
+	if len(s.KeyPrefix) > 0 {
+		list["Condition"] = map[string]interface{}{
+			"StringLike": map[string][]string{"oss:Prefix": {s.KeyPrefix + "*"}},
+		}
+	}
+	content, err := json.Marshal(map[string]interface{}{
+		"Version": "1",
+		"Statement": []interface{}{
+			map[string]interface{}{
+				"Effect":   "Allow",
+				"Action":   actions,
+				"Resource": []string{"acs:oss:*:*:" + s.Bucket + "/" + s.KeyPrefix + "*"},
+			},
+			list,
+		},
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "sts policy")
+	}
+	return string(content), nil
+}
@@ -0,0 +1,169 @@
+package object
+
+// Templates for pfop and save_key settings in qiniu.toml
+//
+// A template is plain text with ${name} or ${name|filter|...} placeholders
+// that are filled in when an upload token is issued. Qiniu magic variables
+// such as $(etag) use parentheses and are passed through untouched.
+//
+// Variables:
+//     user, category           the GetUploadToken arguments
+//     date, year, month, day   the issue date (20060102, 2006, 01, 02)
+//     wmText                   url-safe base64 of "ID:<user>", for watermarks
+//     opt.<name>               a string token option, see options.go
+// Filters:
+//     base64                   url-safe base64 encoding
+//     urlquery                 query escaping
+//
+// user and opt.<name> come from the client. Without a filter their values
+// are limited to letters, digits and "_.-", so that they cannot add fop
+// steps (";", "|"), change the save bucket or escape a key prefix ("/").
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	templateVarUser     = "user"
+	templateVarCategory = "category"
+	templateVarDate     = "date"
+	templateVarYear     = "year"
+	templateVarMonth    = "month"
+	templateVarDay      = "day"
+	templateVarWmText   = "wmText"
+
+	templateOptionPrefix = "opt."
+)
+
+var (
+	templateVars = map[string]bool{
+		templateVarUser:     true,
+		templateVarCategory: true,
+		templateVarDate:     true,
+		templateVarYear:     true,
+		templateVarMonth:    true,
+		templateVarDay:      true,
+		templateVarWmText:   true,
+	}
+	templateFilters = map[string]func(string) string{
+		"base64": func(s string) string {
+			return base64.URLEncoding.EncodeToString([]byte(s))
+		},
+		"urlquery": url.QueryEscape,
+	}
+	templateOptionName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+	// templateSafeValue matches the client values inserted without a filter.
+	templateSafeValue = regexp.MustCompile(`^[A-Za-z0-9_.-]*$`)
+)
+
+// fopTemplate is a parsed template.
+type fopTemplate struct {
+	source   string
+	segments []templateSegment
+}
+
+type templateSegment struct {
+	literal  string
+	variable string
+	filters  []string
+}
+
+// parseTemplate parses source, rejecting unknown variables and filters.
+func parseTemplate(source string) (*fopTemplate, error) {
+	t := &fopTemplate{source: source}
+	rest := source
+	for {
+		start := strings.Index(rest, "${")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(rest[start:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated placeholder in %q", source)
+		}
+		if start > 0 {
+			t.segments = append(t.segments, templateSegment{literal: rest[:start]})
+		}
+
+		parts := strings.Split(rest[start+2:start+end], "|")
+		segment := templateSegment{variable: strings.TrimSpace(parts[0])}
+		if !isTemplateVar(segment.variable) {
+			return nil, fmt.Errorf("unknown variable ${%s} in %q", segment.variable, source)
+		}
+		for _, filter := range parts[1:] {
+			filter = strings.TrimSpace(filter)
+			if _, ok := templateFilters[filter]; !ok {
+				return nil, fmt.Errorf("unknown filter %q in %q", filter, source)
+			}
+			segment.filters = append(segment.filters, filter)
+		}
+		t.segments = append(t.segments, segment)
+		rest = rest[start+end+1:]
+	}
+	if len(rest) > 0 {
+		t.segments = append(t.segments, templateSegment{literal: rest})
+	}
+	return t, nil
+}
+
+func isTemplateVar(name string) bool {
+	if templateVars[name] {
+		return true
+	}
+	return strings.HasPrefix(name, templateOptionPrefix) && templateOptionName.MatchString(name[len(templateOptionPrefix):])
+}
+
+// isClientTemplateVar reports whether the value of name comes from the
+// client.
+func isClientTemplateVar(name string) bool {
+	return name == templateVarUser || strings.HasPrefix(name, templateOptionPrefix)
+}
+
+// render fills in the template. Every referenced variable must be present.
+func (t *fopTemplate) render(vars map[string]string) (string, error) {
+	if t == nil {
+		return "", fmt.Errorf("invalid template, see config validation")
+	}
+	var b strings.Builder
+	for _, segment := range t.segments {
+		if len(segment.variable) == 0 {
+			b.WriteString(segment.literal)
+			continue
+		}
+		value, ok := vars[segment.variable]
+		if !ok {
+			return "", fmt.Errorf("missing value for ${%s}", segment.variable)
+		}
+		if len(segment.filters) == 0 && isClientTemplateVar(segment.variable) && !templateSafeValue.MatchString(value) {
+			return "", fmt.Errorf("unsafe value %q for ${%s}, use a filter", value, segment.variable)
+		}
+		for _, filter := range segment.filters {
+			value = templateFilters[filter](value)
+		}
+		b.WriteString(value)
+	}
+	return b.String(), nil
+}
+
+// makeTemplateVars collects the variables available when issuing a token.
+// options become opt.<name> variables.
+func makeTemplateVars(category string, user string, options map[string]string, now time.Time) map[string]string {
+	vars := map[string]string{
+		templateVarUser:     user,
+		templateVarCategory: category,
+		templateVarDate:     now.Format("20060102"),
+		templateVarYear:     now.Format("2006"),
+		templateVarMonth:    now.Format("01"),
+		templateVarDay:      now.Format("02"),
+		templateVarWmText:   base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("ID:%s", user))),
+	}
+	for name, value := range options {
+		vars[templateOptionPrefix+name] = value
+	}
+	return vars
+}
@@ -73,17 +73,55 @@ func MakeHTTPHandler(s Service, logger log.Logger) http.Handler {
 		encodeResponse,
 		options...,
 	)
+	getProcessingJobHandler := kithttp.NewServer(
+		endpoints.GetProcessingJobEndpoint,
+		decodeGetProcessingJobRequest,
+		encodeResponse,
+		options...,
+	)
+
+	getPrivateURLsHandler := kithttp.NewServer(
+		endpoints.GetPrivateURLsEndpoint,
+		decodeGetPrivateURLsRequest,
+		encodeResponse,
+		options...,
+	)
 
 	r := mux.NewRouter()
 
 	r.Handle("/v1/oss/upload/token", getUploadTokenHandler).Methods("GET").Queries("cloud", "{cloud}", "category", "{category}", "user", "{user}")
 	r.Handle("/v1/oss/secrets", getAccessSecretsHandler).Methods("GET").Queries("cloud", "{cloud}", "bucket", "{bucket}", "options", "{options}")
 	r.Handle("/v1/oss/download/url", getPrivateURLHandler).Methods("GET").Queries("cloud", "{cloud}", "domain", "{domain}", "key", "{key}")
+	r.Handle("/v1/oss/download/urls", getPrivateURLsHandler).Methods("POST")
 	r.Handle("/v1/oss/get/{id:[0-9]+}", getObjectHandler).Methods("GET")
 	r.Handle("/v1/oss/all", getAllObjectsHandler).Methods("GET")
 	r.Handle("/v1/oss/addref", addObjectReferenceHandler).Methods("POST")
 	r.Handle("/v1/oss/delref", removeObjectReferenceHandler).Methods("POST")
 	r.Handle("/v1/oss/del", deleteObjectHandler).Methods("POST")
+	r.Handle("/v1/oss/pfop/{id}", getProcessingJobHandler).Methods("GET")
+
+	return r
+}
+
+// MakeAdminHTTPHandler mounts the admin endpoints, which report credential
+// state and must only be served on a private listener.
+func MakeAdminHTTPHandler(s Service, logger log.Logger) http.Handler {
+	endpoints := MakeServerEndpoints(s, logger)
+	options := []kithttp.ServerOption{
+		kithttp.ServerErrorLogger(logger),
+		kithttp.ServerErrorEncoder(encodeError),
+	}
+
+	getActiveKeysHandler := kithttp.NewServer(
+		endpoints.GetActiveKeysEndpoint,
+		decodeGetActiveKeysRequest,
+		encodeResponse,
+		options...,
+	)
+
+	r := mux.NewRouter()
+
+	r.Handle("/v1/oss/admin/keys", getActiveKeysHandler).Methods("GET")
 
 	return r
 }
@@ -106,6 +144,7 @@ func decodeGetUploadTokenRequest(_ context.Context, r *http.Request) (request in
 		Cloud:    cloud,
 		Category: category,
 		User:     user,
+		Options:  r.URL.Query().Get("options"),
 	}, nil
 }
 
@@ -141,13 +180,37 @@ func decodeGetPrivateURLRequest(_ context.Context, r *http.Request) (request int
 	if len(key) == 0 {
 		return nil, base.NewAppError(ErrInvalidParameter, fmt.Errorf("empty key"))
 	}
+	query := r.URL.Query()
+	options := PrivateURLOptions{
+		Style:   query.Get("style"),
+		Fop:     query.Get("fop"),
+		Attname: query.Get("attname"),
+	}
+	if expires := query.Get("expires"); len(expires) > 0 {
+		options.Expires, err = strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return nil, base.NewAppError(ErrInvalidParameter, errors.Wrap(err, "expires"))
+		}
+	}
 	return getPrivateURLRequest{
-		Cloud:  cloud,
-		Domain: domain,
-		Key:    key,
+		Cloud:   cloud,
+		Domain:  domain,
+		Key:     key,
+		Options: options,
 	}, nil
 }
 
+func decodeGetPrivateURLsRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	var req getPrivateURLsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, base.NewAppError(ErrInvalidBody, errors.Wrap(err, "decodeGetPrivateURLsRequest"))
+	}
+	if len(req.Cloud) == 0 {
+		return nil, base.NewAppError(ErrInvalidParameter, fmt.Errorf("empty cloud"))
+	}
+	return req, nil
+}
+
 func decodeAddObjectReferenceRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
 	body, err := ioutil.ReadAll(r.Body)
 	fmt.Println(string(body))
@@ -200,10 +263,25 @@ func decodeGetObjectRequest(_ context.Context, r *http.Request) (request interfa
 	}, nil
 }
 
+func decodeGetProcessingJobRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+	persistentID := vars["id"]
+	if len(persistentID) == 0 {
+		return nil, base.NewAppError(ErrMissingParameter, fmt.Errorf("missing id"))
+	}
+	return getProcessingJobRequest{
+		PersistentID: persistentID,
+	}, nil
+}
+
 func decodeGetAllObjectsRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
 	return nil, nil
 }
 
+func decodeGetActiveKeysRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	return nil, nil
+}
+
 func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	if e, ok := response.(errorer); ok && e.error() != nil {
 		encodeError(ctx, e.error(), w)
@@ -217,9 +295,6 @@ func encodeError(_ context.Context, err error, w http.ResponseWriter) {
 	if err == nil {
 		panic("encodeError with nil error")
 	}
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(200)
-
 	var status base.Status
 	appErr, ok := err.(*base.AppError)
 	if ok {
@@ -230,6 +305,14 @@ func encodeError(_ context.Context, err error, w http.ResponseWriter) {
 		status.Msg = err.Error()
 	}
 
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	switch status.Code {
+	case ErrDatabaseUnavailable:
+		w.WriteHeader(http.StatusServiceUnavailable)
+	default:
+		w.WriteHeader(200)
+	}
+
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"status": status,
 	})
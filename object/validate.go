@@ -0,0 +1,242 @@
+package object
+
+// Validation of qiniu.toml
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/spf13/viper"
+)
+
+// ConfigProblem describes one invalid setting, identified by its TOML path.
+type ConfigProblem struct {
+	Path    string
+	Message string
+}
+
+func (p ConfigProblem) String() string {
+	return fmt.Sprintf("%s: %s", p.Path, p.Message)
+}
+
+// ValidateConfig loads qiniu.toml from configPath and reports every problem
+// found in it. The error is only set when the file cannot be read.
+func ValidateConfig(configPath string, logger kitlog.Logger) ([]ConfigProblem, error) {
+	qiniuViper := viper.New()
+	qiniuViper.AddConfigPath(configPath)
+	qiniuViper.SetConfigName("qiniu")
+	if err := qiniuViper.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	config, err := loadQiniuConfig(qiniuViper, logger)
+	if err != nil {
+		return nil, err
+	}
+	return config.Validate(), nil
+}
+
+const (
+	callbackBodyTypeForm = "application/x-www-form-urlencoded"
+	callbackBodyTypeJSON = "application/json"
+)
+
+// mimeTypePattern matches one entry of mime_limit, e.g. "image/*" or
+// "image/jpeg".
+var mimeTypePattern = regexp.MustCompile(`^([a-z0-9][a-z0-9.+-]*|\*)/([a-z0-9][a-z0-9.+-]*|\*)$`)
+
+var (
+	styleNamePattern  = regexp.MustCompile(`^[a-z0-9_-]+$`)
+	fopCommandPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*$`)
+)
+
+// Validate reports every problem in the config, sorted by path.
+func (c *qiniuConfig) Validate() []ConfigProblem {
+	problems := append([]ConfigProblem{}, c.loadProblems...)
+	report := func(path string, format string, args ...interface{}) {
+		problems = append(problems, ConfigProblem{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	// The keys may also come from the environment or a secrets file, see
+	// package credentials.
+	if (len(c.AccessKey) == 0) != (len(c.SecretKey) == 0) {
+		report("access_key", "access_key and secret_key must be set together")
+	}
+	if c.TokenDuration <= 0 {
+		report("token_duration", "must be positive, got %d", c.TokenDuration)
+	}
+	if c.PrivateURLDuration <= 0 {
+		report("private_url_duration", "must be positive, got %d", c.PrivateURLDuration)
+	}
+	if len(c.PersistentNotifyURL) > 0 && !isHTTPURL(c.PersistentNotifyURL) {
+		report("persistent_notify_url", "%q is not an http(s) URL", c.PersistentNotifyURL)
+	}
+	if c.SecretsFsizeLimit < 0 {
+		report("secrets_fsize_limit", "must not be negative, got %d", c.SecretsFsizeLimit)
+	}
+	if len(c.SecretsMimeLimit) > 0 {
+		if err := validateMimeLimit(c.SecretsMimeLimit); err != nil {
+			report("secrets_mime_limit", "%s", err)
+		}
+	}
+
+	for name, domain := range c.Domain {
+		if !isHTTPURL(domain) {
+			report("domain."+name, "%q is not an http(s) URL", domain)
+		}
+	}
+	for i, domain := range c.AllowedRawDomains {
+		if len(domainHost(domain)) == 0 {
+			report(fmt.Sprintf("allowed_raw_domains.%d", i), "%q has no host", domain)
+		}
+	}
+	for bucket, policy := range c.Download {
+		path := "download." + bucket
+		if _, ok := c.Domain[bucket]; !ok {
+			report(path, "%q is not declared in [domain]", bucket)
+		}
+		if policy.MaxLifetime < 0 {
+			report(path+".max_lifetime", "must not be negative, got %d", policy.MaxLifetime)
+		}
+		for _, fop := range policy.AllowedFops {
+			if len(fop) == 0 || strings.ContainsAny(fop, "/|") {
+				report(path+".allowed_fops", "%q is not a command name", fop)
+			}
+		}
+	}
+	for name, fop := range c.Style {
+		if !styleNamePattern.MatchString(name) {
+			report("style."+name, "invalid style name")
+		}
+		if err := checkFopSyntax(fop); err != nil {
+			report("style."+name, "%s", err)
+		}
+		for _, cmd := range fopCommands(fop) {
+			if !fopCommandPattern.MatchString(cmd) {
+				report("style."+name, "invalid image processing command %q in %q", cmd, fop)
+			}
+		}
+		if !c.styleAllowed(fop) {
+			report("style."+name, "%q is not within allowed_fops of any [download] bucket", fop)
+		}
+	}
+	if len(c.Category) == 0 {
+		report("category", "no upload categories defined")
+	}
+	for name, category := range c.Category {
+		category.validate("category."+name, c.Domain, report)
+		if len(category.Account) > 0 {
+			if _, ok := c.Account[category.Account]; !ok {
+				report("category."+name+".account", "unknown account %q", category.Account)
+			} else if owner, ok := c.bucketAccount[category.Bucket]; ok && owner != category.Account {
+				report("category."+name+".account", "bucket %q belongs to account %q", category.Bucket, owner)
+			}
+		}
+	}
+	for name, account := range c.Account {
+		for _, bucket := range account.Buckets {
+			if _, ok := c.Domain[bucket]; !ok {
+				report("account."+name+".buckets", "%q is not declared in [domain]", bucket)
+			}
+		}
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Path < problems[j].Path
+	})
+	return problems
+}
+
+func (category *qiniuCategory) validate(path string, domains map[string]string, report func(string, string, ...interface{})) {
+	if len(category.Bucket) == 0 {
+		report(path+".bucket", "must not be empty")
+	} else if _, ok := domains[category.Bucket]; !ok {
+		report(path+".bucket", "%q is not declared in [domain]", category.Bucket)
+	}
+
+	if len(category.Scope) == 0 {
+		report(path+".scope", "must not be empty")
+	} else if scopeBucket := strings.SplitN(category.Scope, ":", 2)[0]; scopeBucket != category.Bucket {
+		report(path+".scope", "bucket %q does not match bucket %q", scopeBucket, category.Bucket)
+	}
+	if category.IsPrefixalScope != 0 && category.IsPrefixalScope != 1 {
+		report(path+".is_prefixal_scope", "must be 0 or 1, got %d", category.IsPrefixalScope)
+	}
+	if category.InsertOnly != 0 && category.InsertOnly != 1 {
+		report(path+".insert_only", "must be 0 or 1, got %d", category.InsertOnly)
+	}
+
+	if category.FsizeLimit < 0 {
+		report(path+".fsize_limit", "must not be negative, got %d", category.FsizeLimit)
+	}
+	if category.FsizeMin < 0 {
+		report(path+".fsize_min", "must not be negative, got %d", category.FsizeMin)
+	}
+	if category.FsizeLimit > 0 && category.FsizeMin > category.FsizeLimit {
+		report(path+".fsize_min", "%d is greater than fsize_limit %d", category.FsizeMin, category.FsizeLimit)
+	}
+	if len(category.MimeLimit) > 0 {
+		if err := validateMimeLimit(category.MimeLimit); err != nil {
+			report(path+".mime_limit", "%s", err)
+		}
+	}
+
+	if len(category.CallbackURL) > 0 && !isHTTPURL(category.CallbackURL) {
+		report(path+".callback_url", "%q is not an http(s) URL", category.CallbackURL)
+	}
+	if len(category.CallbackURL) == 0 && (len(category.CallbackBody) > 0 || len(category.CallbackBodyType) > 0) {
+		report(path+".callback_url", "must be set when callback_body or callback_body_type is set")
+	}
+	// Qiniu does not sign JSON callback bodies.
+	switch category.CallbackBodyType {
+	case "", callbackBodyTypeForm:
+	default:
+		report(path+".callback_body_type", "must be %q, got %q", callbackBodyTypeForm, category.CallbackBodyType)
+	}
+	if len(category.PersistentNotifyURL) > 0 && !isHTTPURL(category.PersistentNotifyURL) {
+		report(path+".persistent_notify_url", "%q is not an http(s) URL", category.PersistentNotifyURL)
+	}
+
+	for _, op := range category.PersistentOps {
+		if len(op.Pfop) == 0 {
+			report(fmt.Sprintf("%s.persistent_ops.%s.pfop", path, op.Name), "must not be empty")
+		}
+	}
+}
+
+// validateMimeLimit checks the Qiniu mimeLimit syntax: a ";" separated list
+// of media types, optionally negated as a whole by a leading "!".
+func validateMimeLimit(mimeLimit string) error {
+	for _, mimeType := range strings.Split(strings.TrimPrefix(mimeLimit, "!"), ";") {
+		if !mimeTypePattern.MatchString(mimeType) {
+			return fmt.Errorf("invalid media type %q in %q", mimeType, mimeLimit)
+		}
+	}
+	return nil
+}
+
+func isHTTPURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && len(u.Host) > 0
+}
+
+// styleAllowed reports whether the download policy of some bucket allows
+// every command of fop, so that the style can be requested at all.
+func (c *qiniuConfig) styleAllowed(fop string) bool {
+	for _, policy := range c.Download {
+		allowed := true
+		for _, cmd := range fopCommands(fop) {
+			if !containsString(policy.AllowedFops, cmd) {
+				allowed = false
+				break
+			}
+		}
+		if allowed {
+			return true
+		}
+	}
+	return false
+}
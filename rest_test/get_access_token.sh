@@ -1,3 +1,6 @@
 #!/usr/bin/env bash
-echo "Get access token from Qiniu"
-http GET http://localhost:8088/v1/oss/secrets?cloud=qiniu&bucket==images&options=''
\ No newline at end of file
+echo "Get an upload token for keys under 100/ in a Qiniu bucket"
+http GET http://localhost:8088/v1/oss/secrets \
+cloud==qiniu \
+bucket==image-avatar \
+options==$(echo -n '{"user":"100"}' | base64 | tr '+/' '-_')
@@ -0,0 +1,6 @@
+#!/usr/bin/env bash
+echo "Get read-only STS credentials for one user from Aliyun"
+http GET http://localhost:8088/v1/oss/secrets \
+cloud==aliyun \
+bucket==docs \
+options==$(echo -n '{"user":"100","read_only":true}' | base64 | tr '+/' '-_')
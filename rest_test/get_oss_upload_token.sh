@@ -0,0 +1,6 @@
+#!/usr/bin/env bash
+echo "Get OSS PostObject policy from Aliyun"
+http GET http://localhost:8088/v1/oss/upload/token \
+cloud==aliyun \
+category==doc \
+user==100
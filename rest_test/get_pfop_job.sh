@@ -0,0 +1,2 @@
+#!/usr/bin/env bash
+http GET http://localhost:8088/v1/oss/pfop/${1:-z0.5a9f4c1fe3d0041bf80ba9b6}
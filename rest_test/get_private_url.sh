@@ -1,6 +1,6 @@
 #!/usr/bin/env bash
 echo "Get private url from Qiniu"
-http GET http://localhost:8088/object/url \
+http GET http://localhost:8088/v1/oss/download/url \
 cloud==qiniu \
-domain==http://p55fwwcvn.bkt.clouddn.com \
+domain==image-public \
 key=='test/2018/03/Fr8RAK-jHIlndVrZoZK9v3T43m5r.jpg'
@@ -0,0 +1,10 @@
+#!/usr/bin/env bash
+echo "Get private urls from Qiniu in one batch"
+echo '{
+  "cloud": "qiniu",
+  "items": [
+    {"domain": "image-avatar", "key": "test/2018/03/Fr8RAK-jHIlndVrZoZK9v3T43m5r.jpg", "style": "avatar-64"},
+    {"domain": "image-identity", "key": "1/2018/03/01/etag", "expires": 60},
+    {"domain": "unknown", "key": "k"}
+  ]
+}' | http POST http://localhost:8088/v1/oss/download/urls
@@ -0,0 +1,6 @@
+#!/usr/bin/env bash
+echo "Get presigned upload from S3/MinIO"
+http GET http://localhost:8088/v1/oss/upload/token \
+cloud==s3 \
+category==photo \
+user==100
@@ -0,0 +1,7 @@
+#!/usr/bin/env bash
+echo "Get an upload token narrowed to 1MiB JPEG images valid for 10 minutes"
+http -v GET http://localhost:8088/v1/oss/upload/token \
+cloud==qiniu \
+category==avatar \
+user==31457281 \
+options==$(echo -n '{"duration":600,"max_size":1048576,"content_type":"image/jpeg"}' | base64 | tr '+/' '-_')
@@ -0,0 +1,3 @@
+#!/usr/bin/env bash
+http GET http://localhost:8088/healthz
+http GET http://localhost:8088/readyz
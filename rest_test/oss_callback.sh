@@ -1,6 +1,11 @@
-
 #!/usr/bin/env bash
-http POST http://localhost:8080/callback/oss-put-object \
+# Requires callback.user_verifier.type = "hmac" with the same secret.
+SECRET=${HMAC_SECRET:-change-me}
+USER_ID=123456
+EXPIRES=$(( $(date +%s) + 600 ))
+SIGNATURE=$(printf '%s:%s' "$USER_ID" "$EXPIRES" | openssl dgst -sha256 -hmac "$SECRET" -binary | base64 | tr '+/' '-_' | tr -d '=')
+
+http POST http://localhost:8088/v1/callback/oss-put-object \
 bucket='moremom-obj' \
 object='joehart.jpg' \
 etag='78F2F5E8F6B7FE9F793F27F0FE291F61' \
@@ -9,6 +14,6 @@ imageInfo.format='jpg' \
 imageInfo.width='457' \
 imageInfo.height='343' \
 appName='moremom' \
-appUserID='123456' \
+appUserID="$USER_ID" \
 appBusiness='avatar' \
-appToken='random_123456'
+appUserToken="$EXPIRES:$SIGNATURE"
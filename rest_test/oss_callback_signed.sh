@@ -0,0 +1,40 @@
+#!/usr/bin/env bash
+# Sends an OSS put-object callback signed with the local fixture key pair.
+#
+# The public key is served over https from 127.0.0.1:8099 with the
+# self-signed oss_pub_key_server_cert.pem, so the server must trust that
+# certificate, e.g. SSL_CERT_FILE=rest_test/fixtures/oss_pub_key_server_cert.pem,
+# and run with
+#     [callback.oss]
+#     verify_signature = true
+#     pub_key_hosts = ["127.0.0.1:8099"]
+# Set TAMPER=1 to corrupt the body after signing; the callback must then be
+# rejected with 401.
+cd "$(dirname "$0")/fixtures" || exit 1
+
+python3 - >/dev/null 2>&1 <<'EOF' &
+import http.server, ssl
+server = http.server.HTTPServer(("127.0.0.1", 8099), http.server.SimpleHTTPRequestHandler)
+context = ssl.SSLContext(ssl.PROTOCOL_TLS_SERVER)
+context.load_cert_chain("oss_pub_key_server_cert.pem", "oss_pub_key_server_key.pem")
+server.socket = context.wrap_socket(server.socket, server_side=True)
+server.serve_forever()
+EOF
+KEY_SERVER=$!
+trap 'kill $KEY_SERVER' EXIT
+sleep 1
+
+CALLBACK_PATH=/v1/callback/oss-put-object
+BODY=$(tr -d '\n' < oss_callback_body.json)
+PUB_KEY_URL=$(printf 'https://127.0.0.1:8099/oss_callback_pub.pem' | base64 | tr -d '\n')
+SIGNATURE=$(printf '%s\n%s' "$CALLBACK_PATH" "$BODY" | openssl dgst -md5 -sign oss_callback_key.pem | base64 | tr -d '\n')
+
+if [ -n "$TAMPER" ]; then
+    BODY=${BODY/17689/17690}
+fi
+
+curl -s -w '\nHTTP %{http_code}\n' -X POST "http://localhost:8088$CALLBACK_PATH" \
+    -H 'Content-Type: application/json' \
+    -H "Authorization: $SIGNATURE" \
+    -H "x-oss-pub-key-url: $PUB_KEY_URL" \
+    --data-binary "$BODY"
@@ -0,0 +1,14 @@
+#!/usr/bin/env bash
+# Sends a Qiniu upload callback signed like Qiniu does ("QBox" authorization).
+# ACCESS_KEY/SECRET_KEY must match qiniu.toml.
+ACCESS_KEY=${ACCESS_KEY:-test-ak}
+SECRET_KEY=${SECRET_KEY:-test-sk}
+
+CALLBACK_PATH=/v1/callback/qiniu-put-object
+BODY='bucket=image-avatar&key=31457281/2018/03/12/Fto5o-5ea0sNMlW_75VgGJCv2AcJ&etag=Fto5o-5ea0sNMlW_75VgGJCv2AcJ&fsize=17689&mimeType=image/jpeg&endUser=31457281&persistentId='
+SIGN=$(printf '%s\n%s' "$CALLBACK_PATH" "$BODY" | openssl dgst -sha1 -hmac "$SECRET_KEY" -binary | base64 | tr '+/' '-_')
+
+curl -s -w '\nHTTP %{http_code}\n' -X POST "http://localhost:8088$CALLBACK_PATH" \
+    -H 'Content-Type: application/x-www-form-urlencoded' \
+    -H "Authorization: QBox $ACCESS_KEY:$SIGN" \
+    --data-binary "$BODY"